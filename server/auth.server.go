@@ -1,6 +1,11 @@
 package server
 
 import (
+	"context"
+	"net"
+	"os"
+	"strings"
+
 	"github.com/thedivinez/go-libs/messaging"
 	"github.com/thedivinez/go-libs/services"
 	"github.com/thedivinez/go-libs/services/auth"
@@ -9,23 +14,70 @@ import (
 	"github.com/thedivinez/go-libs/utils"
 	"github.com/thedivinez/grandaviator/types"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
+// Messenger delivers events to the rooms of the socket service.
+type Messenger interface {
+	Send(event messaging.EventMessage) error
+}
+
+// logMessenger writes events to the debug log. It stands in for the socket
+// service with STORAGE=memory, where nothing else runs.
+type logMessenger struct {
+	log *utils.ServerLogger
+}
+
+func (messenger *logMessenger) Send(event messaging.EventMessage) error {
+	messenger.log.Debug().Str("org", event.OrgId).Str("room", event.Room).Msg(event.Event)
+	return nil
+}
+
 type Server struct {
-	db        storage.Database
-	log       *utils.ServerLogger
-	redis     *storage.RedisCache
-	messaging *messaging.Messenger
-	config    *types.AuthServiceConfig
-	auth      auth.AuthenticationClient
+	db            DocumentStore
+	log           *utils.ServerLogger
+	redis         *storage.RedisCache
+	messaging     Messenger
+	config        *types.AuthServiceConfig
+	auth          auth.AuthenticationClient
+	tracing       *sdktrace.TracerProvider
+	health        *health.Server
+	planes        planeRegistry
+	flightStore   FlightStore
+	betStore      BetStore
+	settingsStore SettingsStore
+	historyStore  HistoryStore
+	chatStore     ChatStore
+	limitStore    LimitStore
+	clock         Clock
+	random        Random
+	books         bookRegistry
+	leases        leaseRegistry
+	instanceID    string
+	peers         peerRegistry
+	dialPeer      func(address string) (*grpc.ClientConn, error)
+	bookReplica   chan bookOp
+	rounds        *roundScheduler
+	streams       streamRegistry
 }
 
 func NewServer() (*Server, error) {
-	server := &Server{log: utils.NewLogger(), config: &types.AuthServiceConfig{}}
-	if err := server.config.ReadFromEnv(); err != nil {
+	config := &types.AuthServiceConfig{}
+	if err := config.ReadFromEnv(); err != nil {
+		return nil, err
+	}
+	server := newServer(config)
+	if err := server.openStorage(); err != nil {
 		return nil, err
 	}
-	if msg, err := messaging.NewClient(server.config.Redis, 1); err == nil {
+	if strings.EqualFold(server.config.Storage, STORAGE_MEMORY) {
+		server.messaging = &logMessenger{log: server.log}
+	} else if msg, err := messaging.NewClient(server.config.Redis, 1); err == nil {
 		server.messaging = msg
 	} else {
 		return nil, err
@@ -35,23 +87,91 @@ func NewServer() (*Server, error) {
 	} else {
 		server.auth = conn
 	}
-	server.redis = storage.NewRedisCache(server.config.Redis, 1)
-	server.db = storage.NewMongoStorage(server.config.MongoDBConfig)
-	clients := []*aviator.PlaneSettings{}
-	if err := server.db.Find(CLIENTS_COLLECTION, bson.M{}, &clients); err != nil {
+	if err := server.startLoops(); err != nil {
 		return nil, err
 	}
+	return server, nil
+}
+
+// newServer builds a server that is not connected to anything yet.
+func newServer(config *types.AuthServiceConfig) *Server {
+	if config.Currency == "" {
+		config.Currency = DEFAULT_CURRENCY
+	}
+	if config.AdvertiseAddress == "" {
+		hostname, _ := os.Hostname()
+		config.AdvertiseAddress = net.JoinHostPort(hostname, strings.TrimPrefix(config.Port, ":"))
+	}
+	return &Server{
+		config:      config,
+		clock:       systemClock{},
+		random:      systemRandom{},
+		log:         utils.NewLogger(),
+		health:      health.NewServer(),
+		bookReplica: make(chan bookOp, BOOK_REPLICA_QUEUE),
+		instanceID:  primitive.NewObjectID().Hex(),
+		dialPeer:    dialPeer,
+	}
+}
+
+// startLoops starts the plane of every org and the background jobs, the
+// stores, messaging and auth have to be connected first.
+func (server *Server) startLoops() error {
+	if err := server.initTracing(); err != nil {
+		return err
+	}
+	if err := server.migrateMoney(); err != nil {
+		return err
+	}
+	clients, err := server.settingsStore.ListSettings(context.Background(), bson.M{})
+	if err != nil {
+		return err
+	}
+	server.rounds = newRoundScheduler(server.clock, server.schedulerWorkers())
+	go server.rounds.run()
 	for idx := range clients {
 		server.initializePlane(clients[idx].OrgID)
 	}
-	return server, nil
+	go server.replicateBooks()
+	go server.dispatchWalletOps()
+	go server.runReconciliations()
+	go server.runCashback()
+	go server.runTournaments()
+	go server.runRiskScans()
+	server.checkHealth()
+	go server.watchHealth()
+	return nil
 }
 
 func (server *Server) Start() error {
-	if service, err := services.NewService(server.config.Port); err != nil {
+	if service, err := services.NewService(server.config.Port, server.serverOptions()...); err != nil {
 		return err
 	} else {
-		aviator.RegisterAviatorServer(service.Server, server)
+		if server.config.MetricsPort != "" {
+			go server.serveMetrics()
+		}
+		server.register(service.Server)
 		return service.Start()
 	}
 }
+
+// Serve answers on a listener of the caller's, the e2e tests serve over bufconn.
+func (server *Server) Serve(listener net.Listener) error {
+	service := grpc.NewServer(server.serverOptions()...)
+	server.register(service)
+	return service.Serve(listener)
+}
+
+func (server *Server) serverOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(server.authenticateUnary),
+		grpc.ChainStreamInterceptor(server.authenticateStream),
+	}
+}
+
+// register adds the aviator and health services.
+func (server *Server) register(service *grpc.Server) {
+	aviator.RegisterAviatorServer(service, server)
+	healthpb.RegisterHealthServer(service, server.health)
+}
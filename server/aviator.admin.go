@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thedivinez/go-libs/services/auth"
+	"github.com/thedivinez/go-libs/utils"
+	"google.golang.org/protobuf/proto"
+)
+
+// adminMethods maps every admin rpc to whether only the platform itself, using
+// a signed request, may call it. The rest are also open to org admins.
+var adminMethods = map[string]bool{
+	"/Aviator/Subscribe":               true,
+	"/Aviator/UpdatePlaneSettings":     false,
+	"/Aviator/AdjustTreasury":          false,
+	"/Aviator/ListPendingWalletOps":    false,
+	"/Aviator/GetReconciliations":      false,
+	"/Aviator/GetSettingsHistory":      false,
+	"/Aviator/IssueFreeBets":           false,
+	"/Aviator/GetCashbackReport":       false,
+	"/Aviator/CreateTournament":        false,
+	"/Aviator/ModerateChat":            false,
+	"/Aviator/SetPlayerGamblingLimits": false,
+	"/Aviator/GetSuspiciousPlayers":    false,
+	"/Aviator/GetPlaneStatus":          false,
+}
+
+type adminContextKey struct{}
+
+type adminCaller struct {
+	Platform bool
+	User     *auth.User
+}
+
+func (caller *adminCaller) Name() string {
+	if caller.Platform {
+		return "platform"
+	}
+	return caller.User.ID
+}
+
+func adminFromContext(ctx context.Context) (*adminCaller, error) {
+	if caller, ok := ctx.Value(adminContextKey{}).(*adminCaller); ok && caller != nil {
+		return caller, nil
+	}
+	return nil, utils.NewServiceError(http.StatusUnauthorized, "request is not authorized")
+}
+
+func adminNonceKey(nonce string) string {
+	return fmt.Sprintf("admin:nonce-%s", nonce)
+}
+
+func (server *Server) signatureHash() func() hash.Hash {
+	if strings.EqualFold(server.config.ApiHash, "sha512") {
+		return sha512.New
+	}
+	return sha256.New
+}
+
+// adminSignature signs the api key, method, timestamp, nonce and a digest of the
+// request body with the api secret, so a captured signature cannot be reused for
+// another rpc or a different payload.
+func (server *Server) adminSignature(method, timestamp, nonce string, req any) (string, error) {
+	body := []byte{}
+	if message, ok := req.(proto.Message); ok {
+		encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(message)
+		if err != nil {
+			return "", err
+		}
+		body = encoded
+	}
+	digest := sha256.Sum256(body)
+	mac := hmac.New(server.signatureHash(), []byte(server.config.ApiSecret))
+	mac.Write([]byte(strings.Join([]string{server.config.ApiKey, method, timestamp, nonce, hex.EncodeToString(digest[:])}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifySignedRequest reports whether the call carries a valid platform signature.
+// Calls without a signature are not an error, they fall back to org admins.
+func (server *Server) verifySignedRequest(ctx context.Context, method string, req any) (bool, error) {
+	signature := metadataValue(ctx, "x-signature")
+	if signature == "" {
+		return false, nil
+	}
+	if server.config.ApiKey == "" || server.config.ApiSecret == "" {
+		return false, utils.NewServiceError(http.StatusUnauthorized, "signed requests are not enabled")
+	}
+	if subtle.ConstantTimeCompare([]byte(metadataValue(ctx, "x-api-key")), []byte(server.config.ApiKey)) != 1 {
+		return false, utils.NewServiceError(http.StatusUnauthorized, "invalid api key")
+	}
+	timestamp := metadataValue(ctx, "x-timestamp")
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false, utils.NewServiceError(http.StatusUnauthorized, "invalid request timestamp").WithInternal(err)
+	}
+	if age := time.Since(time.Unix(signedAt, 0)); age > ADMIN_SIGNATURE_WINDOW || age < -ADMIN_SIGNATURE_WINDOW {
+		return false, utils.NewServiceError(http.StatusUnauthorized, "request signature has expired")
+	}
+	nonce := metadataValue(ctx, "x-nonce")
+	if nonce == "" {
+		return false, utils.NewServiceError(http.StatusUnauthorized, "missing request nonce")
+	}
+	expected, err := server.adminSignature(method, timestamp, nonce, req)
+	if err != nil {
+		return false, utils.NewServiceError(http.StatusBadRequest, "failed to read request").WithInternal(err)
+	}
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return false, utils.NewServiceError(http.StatusUnauthorized, "invalid request signature")
+	}
+	// a nonce is remembered for as long as its signature is valid, so a captured
+	// request cannot be replayed
+	fresh, _, err := server.limitStore.Claim(ctx, adminNonceKey(nonce), ADMIN_SIGNATURE_WINDOW*2)
+	if err != nil {
+		return false, utils.NewServiceError(http.StatusServiceUnavailable, "failed to check request nonce").WithInternal(err)
+	}
+	if !fresh {
+		return false, utils.NewServiceError(http.StatusUnauthorized, "request has already been used")
+	}
+	return true, nil
+}
+
+func (server *Server) authorizeAdmin(ctx context.Context, method string, req any, platformOnly bool) (context.Context, error) {
+	signed, err := server.verifySignedRequest(ctx, method, req)
+	if err != nil {
+		return nil, err
+	}
+	if signed {
+		return context.WithValue(ctx, adminContextKey{}, &adminCaller{Platform: true}), nil
+	}
+	if platformOnly {
+		return nil, utils.NewServiceError(http.StatusForbidden, "this request must be signed by the platform")
+	}
+	user, err := server.verifySession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if user.Role != ROLE_ADMIN {
+		return nil, utils.NewServiceError(http.StatusForbidden, "admin role required")
+	}
+	// org admins may only act on their own org
+	if scoped, ok := req.(interface{ GetOrgID() string }); !ok || scoped.GetOrgID() != user.OrgID {
+		return nil, utils.NewServiceError(http.StatusForbidden, "you are not an admin of this organization")
+	}
+	ctx = context.WithValue(ctx, userContextKey{}, user)
+	return context.WithValue(ctx, adminContextKey{}, &adminCaller{User: user}), nil
+}
@@ -0,0 +1,337 @@
+package server
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"google.golang.org/protobuf/proto"
+)
+
+// betBook is the authoritative list of the bets riding on a flight, with the
+// multiplier the flight is at. It lives in the process that runs the org's
+// plane: placements, cashouts and cancels go through it and the bet store only
+// keeps a copy, written behind it, to pick the round up again after a restart.
+type betBook struct {
+	sync.Mutex
+	orgID      string
+	flightID   string
+	bets       []*aviator.PlaneBet
+	multiplier float64
+	tickedAt   int64
+	dirty      bool
+	// flying is set once the flight took off, bets can only be cashed out after
+	flying bool
+	// sealed is set once the flight has exploded, nothing can be taken after
+	sealed bool
+}
+
+type bookRegistry struct {
+	sync.Mutex
+	orgs map[string]map[string]*betBook
+}
+
+// bookOp is a change to a book that still has to be written to the bet store.
+type bookOp struct {
+	kind     string
+	orgID    string
+	flightID string
+	bet      *aviator.PlaneBet
+}
+
+func newBetBook(flight *aviator.Flight) *betBook {
+	return &betBook{orgID: flight.OrgID, flightID: flight.ID, multiplier: flight.Multiplier, tickedAt: flight.TickedAt, flying: flight.State == STATE_FLYING}
+}
+
+func (book *betBook) add(bet *aviator.PlaneBet) {
+	book.Lock()
+	defer book.Unlock()
+	book.bets = append(book.bets, proto.Clone(bet).(*aviator.PlaneBet))
+}
+
+func (book *betBook) hasSideBet(userID, side string) bool {
+	book.Lock()
+	defer book.Unlock()
+	return slices.ContainsFunc(book.bets, func(bet *aviator.PlaneBet) bool {
+		return bet.UserID == userID && bet.Side == side
+	})
+}
+
+// take removes a bet of the user and returns it with the multiplier and tick
+// the flight was at when it was taken. A sealed book gives nothing out and a
+// flying one nothing that is only open to be taken before take off.
+func (book *betBook) take(betID, userID string, openOnly bool) (*aviator.PlaneBet, float64, int64, error) {
+	book.Lock()
+	defer book.Unlock()
+	if book.sealed {
+		return nil, 0, 0, errors.WithStack(errFlightEnded)
+	}
+	if openOnly && book.flying {
+		return nil, 0, 0, errors.WithStack(errBetFlying)
+	}
+	idx := slices.IndexFunc(book.bets, func(bet *aviator.PlaneBet) bool {
+		return bet.BetId == betID && bet.UserID == userID
+	})
+	if idx < 0 {
+		return nil, 0, 0, errors.WithStack(errBetNotFound)
+	}
+	bet := book.bets[idx]
+	book.bets = slices.Delete(book.bets, idx, idx+1)
+	return bet, book.multiplier, book.tickedAt, nil
+}
+
+func (book *betBook) takeOff() {
+	book.Lock()
+	defer book.Unlock()
+	book.flying = true
+}
+
+func (book *betBook) seal() {
+	book.Lock()
+	defer book.Unlock()
+	book.sealed = true
+}
+
+func (book *betBook) snapshot() []aviator.PlaneBet {
+	book.Lock()
+	defer book.Unlock()
+	bets := make([]aviator.PlaneBet, len(book.bets))
+	for idx, bet := range book.bets {
+		proto.Merge(&bets[idx], bet)
+	}
+	return bets
+}
+
+func (book *betBook) userBets(userID string) []*aviator.PlaneBet {
+	book.Lock()
+	defer book.Unlock()
+	bets := []*aviator.PlaneBet{}
+	for _, bet := range book.bets {
+		if bet.UserID == userID {
+			bets = append(bets, proto.Clone(bet).(*aviator.PlaneBet))
+		}
+	}
+	return bets
+}
+
+func (book *betBook) tick(multiplier float64, tickedAt int64) {
+	book.Lock()
+	defer book.Unlock()
+	book.multiplier, book.tickedAt, book.dirty = multiplier, tickedAt, true
+}
+
+// flush returns the position of the flight when it moved since the last flush.
+func (book *betBook) flush() (float64, int64, bool) {
+	book.Lock()
+	defer book.Unlock()
+	dirty := book.dirty
+	book.dirty = false
+	return book.multiplier, book.tickedAt, dirty
+}
+
+func (server *Server) registerBook(book *betBook) {
+	if server.books.orgs == nil {
+		server.books.orgs = map[string]map[string]*betBook{}
+	}
+	if server.books.orgs[book.orgID] == nil {
+		server.books.orgs[book.orgID] = map[string]*betBook{}
+	}
+	server.books.orgs[book.orgID][book.flightID] = book
+}
+
+// openBook starts the empty book of a new flight.
+func (server *Server) openBook(flight *aviator.Flight) {
+	server.books.Lock()
+	server.registerBook(newBetBook(flight))
+	server.books.Unlock()
+	server.replicateBook(bookOp{kind: BOOK_OP_OPEN, orgID: flight.OrgID, flightID: flight.ID})
+}
+
+// getBook returns the book of a flight. A flight from before a restart has its
+// book read back from the bet store the first time it is needed.
+func (server *Server) getBook(ctx context.Context, orgID, flightID string) (*betBook, error) {
+	server.books.Lock()
+	defer server.books.Unlock()
+	if book, ok := server.books.orgs[orgID][flightID]; ok {
+		return book, nil
+	}
+	flight, err := server.flightStore.GetFlight(ctx, orgID, flightID)
+	if err != nil {
+		return nil, errors.WithStack(errFlightNotFound)
+	}
+	book := newBetBook(flight)
+	if bets, err := server.betStore.GetBets(ctx, orgID, flightID); err != nil {
+		server.log.Err(err).Msgf("failed to read back the bets of flight %s", flightID)
+	} else {
+		for idx := range bets {
+			book.bets = append(book.bets, &bets[idx])
+		}
+	}
+	server.registerBook(book)
+	return book, nil
+}
+
+// takeOffBook stops the bets of a flight that took off from being canceled,
+// their stakes are in the round from then on.
+func (server *Server) takeOffBook(orgID, flightID string) {
+	if book, err := server.getBook(context.Background(), orgID, flightID); err == nil {
+		book.takeOff()
+	}
+}
+
+// sealBook stops the bets of a flight that exploded from being taken, the
+// settlement reads the book after and every bet left in it is lost.
+func (server *Server) sealBook(orgID, flightID string) {
+	if book, err := server.getBook(context.Background(), orgID, flightID); err == nil {
+		book.seal()
+	}
+}
+
+// closeBook drops the book of a flight that has been settled.
+func (server *Server) closeBook(orgID, flightID string) {
+	server.books.Lock()
+	delete(server.books.orgs[orgID], flightID)
+	server.books.Unlock()
+	server.replicateBook(bookOp{kind: BOOK_OP_CLOSE, orgID: orgID, flightID: flightID})
+}
+
+func (server *Server) addBet(ctx context.Context, bet *aviator.PlaneBet) error {
+	book, err := server.getBook(ctx, bet.OrgID, bet.FlightID)
+	if err != nil {
+		return err
+	}
+	book.add(bet)
+	server.replicateBook(bookOp{kind: BOOK_OP_ADD, orgID: bet.OrgID, flightID: bet.FlightID, bet: proto.Clone(bet).(*aviator.PlaneBet)})
+	return nil
+}
+
+func (server *Server) hasSideBet(ctx context.Context, flight *aviator.Flight, userID, side string) (bool, error) {
+	book, err := server.getBook(ctx, flight.OrgID, flight.ID)
+	if err != nil {
+		return false, err
+	}
+	return book.hasSideBet(userID, side), nil
+}
+
+// takeBet removes a bet of the user from the flight and returns it, only one
+// caller can take the same bet. The flight is moved to the multiplier the bet
+// was taken at. Bets of a flight that took off are left alone when openOnly is set.
+func (server *Server) takeBet(ctx context.Context, flight *aviator.Flight, betID, userID string, openOnly bool) (*aviator.PlaneBet, error) {
+	book, err := server.getBook(ctx, flight.OrgID, flight.ID)
+	if err != nil {
+		return nil, err
+	}
+	bet, multiplier, tickedAt, err := book.take(betID, userID, openOnly)
+	if err != nil {
+		return nil, err
+	}
+	flight.Multiplier, flight.TickedAt = multiplier, tickedAt
+	server.replicateBook(bookOp{kind: BOOK_OP_TAKE, orgID: flight.OrgID, flightID: flight.ID, bet: proto.Clone(bet).(*aviator.PlaneBet)})
+	return bet, nil
+}
+
+// tickFlight moves the book to the flight's multiplier, the flight store gets
+// it on the next flush.
+func (server *Server) tickFlight(flight *aviator.Flight) {
+	if book, err := server.getBook(context.Background(), flight.OrgID, flight.ID); err == nil {
+		book.tick(flight.Multiplier, flight.TickedAt)
+	}
+}
+
+// activeBets returns the bets the user has riding. The books this instance
+// runs are ahead of the bet store, the other flights are read from its index
+// of the user's bets.
+func (server *Server) activeBets(ctx context.Context, orgID, userID string) ([]*aviator.PlaneBet, error) {
+	stored, err := server.betStore.GetUserBets(ctx, orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	server.books.Lock()
+	books := maps.Clone(server.books.orgs[orgID])
+	server.books.Unlock()
+	bets := []*aviator.PlaneBet{}
+	for _, bet := range stored {
+		if _, ok := books[bet.FlightID]; !ok {
+			bets = append(bets, bet)
+		}
+	}
+	for _, book := range books {
+		bets = append(bets, book.userBets(userID)...)
+	}
+	return bets, nil
+}
+
+// dropBooks forgets the books of an org whose rounds went to another instance,
+// they are read back from the bet store if the rounds come back.
+func (server *Server) dropBooks(orgID string) {
+	server.books.Lock()
+	delete(server.books.orgs, orgID)
+	server.books.Unlock()
+}
+
+// replicateBook queues a change for the bet store. Callers wait when the queue
+// is full so the copy never skips a change.
+func (server *Server) replicateBook(op bookOp) {
+	server.bookReplica <- op
+	bookReplicaBacklog.Set(float64(len(server.bookReplica)))
+}
+
+func (server *Server) applyBookOp(ctx context.Context, op bookOp) error {
+	switch op.kind {
+	case BOOK_OP_OPEN:
+		return server.betStore.OpenBook(ctx, op.orgID, op.flightID)
+	case BOOK_OP_ADD:
+		return server.betStore.AddBet(ctx, op.bet)
+	case BOOK_OP_TAKE:
+		_, err := server.betStore.TakeBet(ctx, op.orgID, op.flightID, op.bet.BetId, op.bet.UserID, false)
+		return err
+	case BOOK_OP_CLOSE:
+		return server.betStore.DeleteBook(ctx, op.orgID, op.flightID)
+	}
+	return errors.Errorf("unknown book op %s", op.kind)
+}
+
+// flushFlights writes the multiplier of the flights that moved since the last
+// flush, so the flight store trails the loop by at most one flush.
+func (server *Server) flushFlights(ctx context.Context) {
+	server.books.Lock()
+	books := []*betBook{}
+	for _, flights := range server.books.orgs {
+		for _, book := range flights {
+			books = append(books, book)
+		}
+	}
+	server.books.Unlock()
+	for _, book := range books {
+		if multiplier, tickedAt, dirty := book.flush(); dirty {
+			fields := map[string]any{"multiplier": multiplier, "tickedAt": tickedAt}
+			if err := server.flightStore.SetFlightFields(ctx, book.orgID, book.flightID, fields); err != nil {
+				bookReplicaFailures.WithLabelValues("flush").Inc()
+				server.log.Err(err).Msgf("failed to flush flight %s", book.flightID)
+			}
+		}
+	}
+}
+
+// replicateBooks writes the books behind the flight loop, in the order they
+// changed.
+func (server *Server) replicateBooks() {
+	ticker := time.NewTicker(BOOK_FLUSH_EVERY)
+	defer ticker.Stop()
+	for {
+		select {
+		case op := <-server.bookReplica:
+			bookReplicaBacklog.Set(float64(len(server.bookReplica)))
+			if err := server.applyBookOp(context.Background(), op); err != nil {
+				bookReplicaFailures.WithLabelValues(op.kind).Inc()
+				server.log.Err(err).Msgf("failed to replicate %s of flight %s", op.kind, op.flightID)
+			}
+		case <-ticker.C:
+			server.flushFlights(context.Background())
+		}
+	}
+}
@@ -10,9 +10,10 @@ import (
 	"github.com/thedivinez/go-libs/messaging"
 	"github.com/thedivinez/go-libs/services/auth"
 	"github.com/thedivinez/go-libs/services/aviator"
-	"github.com/thedivinez/go-libs/utils"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
 )
 
 func planeflightRedisKey(orgId, flightId string) string {
@@ -32,118 +33,169 @@ func (server *Server) getCurrentUserBalance(user *auth.User) float64 {
 }
 
 func (server *Server) getFlightById(orgId, flightId string) (*aviator.Flight, error) {
-	flight := aviator.Flight{}
-	if err := server.redis.Read(fmt.Sprintf("%s-plane:flight-%s", orgId, flightId), "$", &flight); err != nil {
-		return nil, err
-	}
-	return &flight, nil
+	return server.flightStore.GetFlight(context.Background(), orgId, flightId)
 }
 
 func (server *Server) getPlaneSettings(orgId string) *aviator.PlaneSettings {
-	balances := aviator.PlaneSettings{}
-	server.db.FindOne(CLIENTS_COLLECTION, bson.M{"orgId": orgId}, &balances)
-	return &balances
+	settings, err := server.settingsStore.GetSettings(context.Background(), orgId)
+	if err != nil {
+		return &aviator.PlaneSettings{}
+	}
+	return settings
 }
 
-func (server *Server) getPlaneBets(orgId, flightId, filter string) []aviator.PlaneBet {
-	bets := []aviator.PlaneBet{}
-	if err := server.redis.Read(flightBetsRedisKey(orgId, flightId), filter, &bets); err != nil {
+func (server *Server) getPlaneBets(orgId, flightId string) []aviator.PlaneBet {
+	book, err := server.getBook(context.Background(), orgId, flightId)
+	if err != nil {
 		server.log.Err(err).Msg("failed to read bets")
+		return []aviator.PlaneBet{}
 	}
-	return bets
+	return book.snapshot()
 }
 
-func (server *Server) getFlightByState(orgId, state string) (*aviator.Flight, error) {
-	ctx := context.Background()
-	for iter := server.redis.Scan(ctx, 0, fmt.Sprintf("%s-plane:flight-*", orgId), 0); iter.Next(ctx); {
-		flight := aviator.Flight{}
-		if err := server.redis.Read(iter.Val(), "$", &flight); err != nil {
-			return nil, err
-		}
-		if flight.State == state {
-			return &flight, nil
+func liveBets(bets []aviator.PlaneBet) []aviator.PlaneBet {
+	live := []aviator.PlaneBet{}
+	for idx := range bets {
+		if bets[idx].Account == "live" {
+			live = append(live, aviator.PlaneBet{})
+			proto.Merge(&live[len(live)-1], &bets[idx])
 		}
 	}
-	return nil, errors.WithStack(errors.New("no flight found"))
+	return live
+}
+
+// refundUnvaluedBet takes a bet out of a round that has no exchange rate for its
+// currency and gives the stake back, the round could not account for its payout.
+func (server *Server) refundUnvaluedBet(ctx context.Context, flight *aviator.Flight, bet *aviator.PlaneBet) {
+	taken, err := server.takeBet(ctx, &aviator.Flight{OrgID: flight.OrgID, ID: flight.ID}, bet.BetId, bet.UserID, false)
+	if err != nil {
+		server.log.Err(err).Msgf("failed to take unvalued bet %s", bet.BetId)
+		return
+	}
+	if taken.FreeBetID != "" {
+		server.releaseFreeBet(taken)
+	} else if err := server.creditWallet(ctx, newWalletOp(taken, server.moneyMinor(taken.StakeMoney, taken.Stake), WALLET_REASON_REFUND)); err != nil {
+		server.log.Err(err).Msgf("failed to refund unvalued bet %s", taken.BetId)
+	}
+	taken.Status = "canceled"
+	server.sendEvent(ctx, messaging.EventMessage{Event: "flightbet:update", Room: taken.UserID, OrgId: taken.OrgID, Message: taken})
 }
 
-func (server *Server) broadcastFlightState(flight *aviator.Flight) {
-	server.messaging.Send(messaging.EventMessage{
+func (server *Server) restorePlaneBet(bet *aviator.PlaneBet) {
+	if err := server.addBet(context.Background(), bet); err != nil {
+		server.log.Err(err).Msgf("failed to restore bet %s", bet.BetId)
+	}
+}
+
+func (server *Server) getFlightByState(ctx context.Context, orgId, state string) (*aviator.Flight, error) {
+	ctx, span := startSpan(ctx, "getFlightByState", attribute.String("org", orgId), attribute.String("state", state))
+	flight, err := server.flightStore.FindFlight(ctx, orgId, state)
+	if errors.Is(err, errFlightNotFound) {
+		span.End()
+		return nil, err
+	}
+	endSpan(span, err)
+	return flight, err
+}
+
+// broadcastFlightState tells the org's clients where the flight is, as a whole
+// flight:state at phase changes and as a flight:delta in between.
+func (server *Server) broadcastFlightState(ctx context.Context, flight *aviator.Flight) {
+	state := &aviator.FlightState{
+		State:      flight.State,
+		ID:         flight.ID,
+		TotalBets:  flight.TotalBets,
+		Multiplier: fmt.Sprintf("%.2fx", flight.Multiplier-0.01),
+	}
+	// the loop keeps moving the leaderboard, the stream compares against a copy
+	for _, entry := range flight.LeaderBoard {
+		state.LeaderBoard = append(state.LeaderBoard, proto.Clone(entry).(*aviator.FlightLeaderBoard))
+	}
+	event, message := server.nextFlightMessage(flight.OrgID, state)
+	server.sendEvent(ctx, messaging.EventMessage{
 		Room:    "plane",
 		Service: "aviator",
 		OrgId:   flight.OrgID,
-		Event:   "flight:state",
-		Message: &aviator.FlightState{
-			State:       flight.State,
-			ID:          flight.ID,
-			TotalBets:   flight.TotalBets,
-			LeaderBoard: flight.LeaderBoard,
-			Multiplier:  fmt.Sprintf("%.2fx", flight.Multiplier-0.01),
-		},
+		Event:   event,
+		Message: message,
 	})
 }
 
-func generateName() string {
+func (server *Server) generateName() string {
 	alphabet := []rune("abcdefghijklmnopqrstuvwxyz")
-	lastLetter := string(alphabet[utils.RandInt(0, len(alphabet))])
-	firstLetter := string(alphabet[utils.RandInt(0, len(alphabet))])
+	lastLetter := string(alphabet[server.random.Int(0, len(alphabet))])
+	firstLetter := string(alphabet[server.random.Int(0, len(alphabet))])
 	return fmt.Sprintf("%s***%s", firstLetter, lastLetter)
 }
 
 func (server *Server) generateLeaderBoard() []*aviator.FlightLeaderBoard {
 	leaderBoard := []*aviator.FlightLeaderBoard{}
 	for i := 0; i < 19; i++ {
-		name := generateName()
+		name := server.generateName()
 		for slices.ContainsFunc(leaderBoard, func(x *aviator.FlightLeaderBoard) bool {
 			return x.Name == name
 		}) {
-			name = generateName()
+			name = server.generateName()
 		}
 		leaderBoard = append(leaderBoard, &aviator.FlightLeaderBoard{
 			PayOut:    0,
 			Name:      name,
 			CashedOut: false,
-			Stake:     utils.RandFloat(1.0, 100.0),
+			Stake:     server.random.Float(1.0, 100.0),
 		})
 	}
 	return leaderBoard
 }
 
-func (server *Server) createNextFlight(orgID string) *aviator.Flight {
-	if pendingFlight, err := server.getFlightByState(orgID, STATE_PENDING); err == nil {
+func (server *Server) createNextFlight(ctx context.Context, orgID string) *aviator.Flight {
+	if pendingFlight, err := server.getFlightByState(ctx, orgID, STATE_PENDING); err == nil {
 		return pendingFlight
 	}
-	if loadingFlight, err := server.getFlightByState(orgID, STATE_LOADING); err == nil {
+	if loadingFlight, err := server.getFlightByState(ctx, orgID, STATE_LOADING); err == nil {
 		return loadingFlight
 	}
 	flight := &aviator.Flight{
 		Multiplier:  1.0,
 		OrgID:       orgID,
 		State:       STATE_PENDING,
-		DateCreated: time.Now().Unix(),
+		DateCreated: server.clock.Now().Unix(),
 		LeaderBoard: []*aviator.FlightLeaderBoard{},
 		ID:          primitive.NewObjectID().Hex(),
 	}
-	if err := server.redis.Write(planeflightRedisKey(orgID, flight.ID), "$", flight); err != nil {
-		server.log.Err(err).Msg("failed to write flight")
-	}
-	if err := server.redis.Write(flightBetsRedisKey(orgID, flight.ID), "$", []aviator.PlaneBet{}); err != nil {
-		server.log.Err(err).Msg("failed to initialize flight bets")
+	flight.RiskMoney, flight.ProfitBlownMoney = server.newMoney(0), server.newMoney(0)
+	if err := server.flightStore.SaveFlight(ctx, flight); err != nil {
+		server.planeFailed(orgID, err, "failed to write flight")
 	}
-	if err := server.db.UpdateOne(CLIENTS_COLLECTION, bson.M{"orgId": orgID}, bson.M{"$inc": bson.M{"amountToRisk": -flight.Risk}}); err != nil {
+	server.openBook(flight)
+	settings := server.getPlaneSettings(orgID)
+	update := server.treasuryUpdate(settings, server.baseCurrency(settings), "$inc", map[string]int64{"amountToRisk": -flight.RiskMoney.Minor})
+	if err := server.settingsStore.UpdateSettings(ctx, bson.M{"orgId": orgID}, update); err != nil {
 		server.log.Err(err).Msg("failed to write flight")
 	}
 	return flight
 }
 
+func (server *Server) snapshotFlightSettings(ctx context.Context, flight *aviator.Flight, settings *aviator.PlaneSettings) {
+	flight.Settings = settings
+	flight.SettingsVersion = settings.Version
+	fields := map[string]any{"settings": flight.Settings, "settingsVersion": flight.SettingsVersion}
+	if err := server.flightStore.SetFlightFields(ctx, flight.OrgID, flight.ID, fields); err != nil {
+		server.log.Err(err).Msg("failed to snapshot flight settings")
+	}
+}
+
 func (server *Server) initializePlane(orgID string) {
 	go func() {
-		flights := 0
+		flights, waiting := 0, false
+		server.planeStarted(orgID)
+		server.rounds.start(orgID)
+		defer server.rounds.stop()
 		for {
 			settings := server.getPlaneSettings(orgID)
-			if time.Unix(settings.LisenseExpiration, 0).After(time.Now()) {
+			if time.Unix(settings.LisenseExpiration, 0).After(server.clock.Now()) {
 				server.log.Log().Msg("lisense expired")
-				server.messaging.Send(messaging.EventMessage{
+				server.planeStopped(orgID, "license expired")
+				server.sendEvent(context.Background(), messaging.EventMessage{
 					OrgId:   orgID,
 					Room:    "admin",
 					Service: "aviator",
@@ -152,85 +204,156 @@ func (server *Server) initializePlane(orgID string) {
 				})
 				return
 			}
-			flight, err := server.getFlightByState(orgID, STATE_FLYING)
+			if !server.keepRounds(orgID) {
+				// another instance runs the rounds, they are picked up from the stores
+				// when it lets them go
+				if !waiting {
+					server.planeStopped(orgID, "the rounds run on another instance")
+					server.dropBooks(orgID)
+					waiting = true
+				}
+				server.rounds.sleep(orgID, ROUND_LEASE_RENEW)
+				continue
+			}
+			if waiting {
+				server.planeStarted(orgID)
+				waiting = false
+			}
+			ctx, round := startSpan(context.Background(), "round", attribute.String("org", orgID))
+			flight, err := server.getFlightByState(ctx, orgID, STATE_FLYING)
 			if err != nil {
-				flight = server.createNextFlight(orgID)
+				flight = server.createNextFlight(ctx, orgID)
 			}
-			totalStakes := 0.0
+			totalStakes := int64(0)
 			server.log.Log().Msg("starting flight")
-			flightRedisKey := planeflightRedisKey(orgID, flight.ID)
+			// the round runs under the settings it started with, changes apply from the next round
+			if flight.Settings == nil {
+				server.snapshotFlightSettings(ctx, flight, settings)
+			}
+			settings = flight.Settings
+			round.SetAttributes(attribute.String("flight", flight.ID))
+			flight.LeaderBoard = server.generateLeaderBoard()
+			flight.TotalBets = int64(server.random.Int(int(settings.MinTotalBets), int(settings.MaxTotalBets)))
 			if flight.State != STATE_FLYING {
-				for timeBeforeStart := range utils.StartCountDown(time.Now(), time.Now().Add(time.Second*14)) {
-					if timeBeforeStart.T <= 0 {
+				countdownCtx, countdown := startSpan(ctx, "round.countdown")
+				for timeBeforeStart := range server.countdown(orgID, time.Second*14) {
+					if !server.keepRounds(orgID) {
+						break
+					}
+					if timeBeforeStart <= 0 {
 						flights++
 						flight.State = STATE_FLYING
-						if bets := server.getPlaneBets(orgID, flight.ID, "$.[?(@.account=='live')]"); len(bets) > 0 {
+						server.takeOffBook(orgID, flight.ID)
+						if bets := liveBets(server.getPlaneBets(orgID, flight.ID)); len(bets) > 0 {
+							stakes := map[string]int64{}
 							for idx := range bets {
-								totalStakes += bets[idx].Stake
+								currency := server.betCurrency(settings, &bets[idx])
+								if _, err := server.toBase(settings, 0, currency); err != nil {
+									server.planeFailed(orgID, err, "refunding a bet the round cannot value")
+									server.refundUnvaluedBet(countdownCtx, flight, &bets[idx])
+									continue
+								}
+								// nobody paid the stake of a free bet, only its winnings count
+								// against the round's risk
+								if bets[idx].FreeBetID != "" {
+									stakes[currency] += 0
+									continue
+								}
+								stake := server.moneyMinor(bets[idx].StakeMoney, bets[idx].Stake)
+								server.observeStake(settings, currency, stake)
+								// the share of the stake that goes to the jackpot is not the round's
+								stakes[currency] += stake - server.contributeToJackpot(settings, &bets[idx], stake)
+							}
+							// each currency funds its share of the risk from its own pool, the
+							// round itself is tracked in the base currency
+							risk, riskPercentage := int64(0), server.random.Float(settings.MinRiskPercentage, settings.MaxRiskPercentage)
+							flight.Exposures = map[string]*aviator.CurrencyExposure{}
+							for currency, staked := range stakes {
+								riskAmount := server.fundFlightRisk(settings, currency, scaleMinor(staked, riskPercentage))
+								flight.Exposures[currency] = &aviator.CurrencyExposure{Risk: staked + riskAmount}
+								baseStaked, _ := server.toBase(settings, staked, currency)
+								baseRisk, _ := server.toBase(settings, staked+riskAmount, currency)
+								totalStakes, risk = totalStakes+baseStaked, risk+baseRisk
 							}
-							riskAmount := utils.RandFloat(settings.MinRiskPercentage, settings.MaxRiskPercentage) * totalStakes
-							if riskAmount <= settings.AmountToRisk {
-								server.db.UpdateOne(CLIENTS_COLLECTION, bson.M{"orgId": orgID}, bson.M{"$inc": bson.M{"amountToRisk": -riskAmount}})
-							} else if riskAmount <= settings.ReservedBalance {
-								server.db.UpdateOne(CLIENTS_COLLECTION, bson.M{"orgId": orgID}, bson.M{"$inc": bson.M{"reservedBalance": -riskAmount}})
-							} else if riskAmount <= (settings.ReservedBalance + settings.AmountToRisk) {
-								combinedBalance := settings.ReservedBalance + settings.AmountToRisk
-								server.db.UpdateOne(CLIENTS_COLLECTION, bson.M{"orgId": orgID}, bson.M{"$set": bson.M{"amountToRisk": combinedBalance - riskAmount, "reservedBalance": 0.0}})
-							} else {
-								riskAmount = 0
+							flight.Risk, flight.RiskMoney = fromMinor(risk, server.baseCurrency(settings)), money(risk, server.baseCurrency(settings))
+							fields := map[string]any{"risk": flight.Risk, "riskMoney": flight.RiskMoney, "exposures": flight.Exposures}
+							if err := server.flightStore.SetFlightFields(countdownCtx, orgID, flight.ID, fields); err != nil {
+								server.planeFailed(orgID, err, "failed to write flight risk")
 							}
-							flight.Risk = totalStakes + riskAmount
-							server.redis.Write(flightRedisKey, "$.risk", flight.Risk)
+							server.observeTreasury(orgID)
 						} else {
-							flight.Risk = utils.RandFloat(settings.MinDemoRiskAmount, settings.MaxDemoRiskAmount)
+							demoRisk := toMinor(server.random.Float(settings.MinDemoRiskAmount, settings.MaxDemoRiskAmount), server.baseCurrency(settings))
+							flight.Risk, flight.RiskMoney = fromMinor(demoRisk, server.baseCurrency(settings)), money(demoRisk, server.baseCurrency(settings))
 						}
-						if err := server.redis.Write(flightRedisKey, "$.state", flight.State); err != nil {
-							server.log.Err(err).Msg("failed to update flight state")
+						if err := server.flightStore.SetFlightFields(countdownCtx, orgID, flight.ID, map[string]any{"state": flight.State}); err != nil {
+							server.planeFailed(orgID, err, "failed to update flight state")
 						}
-						server.broadcastFlightState(flight)
-						server.createNextFlight(orgID)
+						server.planeTicked(flight)
+						server.broadcastFlightState(countdownCtx, flight)
+						server.createNextFlight(countdownCtx, orgID)
 						break
 					}
 					flight.State = STATE_LOADING
-					if err := server.redis.Write(flightRedisKey, "$.state", flight.State); err != nil {
-						server.log.Err(err).Msg("failed to update flight state")
+					if err := server.flightStore.SetFlightFields(countdownCtx, orgID, flight.ID, map[string]any{"state": flight.State}); err != nil {
+						server.planeFailed(orgID, err, "failed to update flight state")
 					}
+					server.planeTicked(flight)
 
-					server.broadcastFlightState(flight)
+					server.broadcastFlightState(countdownCtx, flight)
 				}
+				countdown.End()
+			}
+			if !server.ownsRounds(orgID) {
+				round.End()
+				continue
 			}
 
-			flight.LeaderBoard = server.generateLeaderBoard()
-			flight.TotalBets = int64(utils.RandInt(int(settings.MinTotalBets), int(settings.MaxTotalBets)))
-			for range time.NewTicker(time.Millisecond * 120).C {
-				flightRiskUsed := 0.0
+			flyingCtx, flying := startSpan(ctx, "round.flight")
+			flightRisk := server.moneyMinor(flight.RiskMoney, flight.Risk)
+			for range server.rounds.ticks(orgID, FLIGHT_TICK_INTERVAL) {
+				if !server.keepRounds(orgID) {
+					// the flight stays in the stores for the instance that takes over
+					flying.End()
+					round.End()
+					break
+				}
+				server.planeTicked(flight)
+				flightRiskUsed := int64(0)
 				flight.Multiplier += 0.01
 				if flight.Multiplier >= 3.0 {
-					flight.Multiplier += utils.RandFloat(0.01, settings.MaxMultiplierShift)
+					flight.Multiplier += server.random.Float(0.01, settings.MaxMultiplierShift)
 				}
 
 				if flights >= int(settings.AutoExplodeAfter) {
 					flights = 0
-					flightRiskUsed = flight.Risk
+					flightRiskUsed = flightRisk
 				}
 
-				if flightRiskUsed < flight.Risk {
-					bets := server.getPlaneBets(orgID, flight.ID, "$")
+				if flightRiskUsed < flightRisk {
+					bets := server.getPlaneBets(orgID, flight.ID)
+					openBets.WithLabelValues(orgID).Set(float64(len(bets)))
 					if len(bets) == 0 || totalStakes == 0 {
-						flightRiskUsed += utils.RandFloat(settings.MaxDemoStake, settings.MaxDemoStake) * flight.Multiplier
+						flightRiskUsed += payoutMinor(toMinor(server.random.Float(settings.MaxDemoStake, settings.MaxDemoStake), server.baseCurrency(settings)), flight.Multiplier)
 					}
 					for idx := range bets {
 						bets[idx].Status = "closed"
-						payout := bets[idx].Stake * flight.Multiplier
+						currency := server.betCurrency(settings, &bets[idx])
+						payout := payoutMinor(server.moneyMinor(bets[idx].StakeMoney, bets[idx].Stake), flight.Multiplier)
 						if bets[idx].Account == "live" {
-							flightRiskUsed += payout
+							basePayout, err := server.toBase(settings, payout, currency)
+							if err != nil {
+								// a payout the round cannot value could be any size, the round ends
+								server.planeFailed(orgID, err, "failed to value a payout")
+								basePayout = flightRisk
+							}
+							flightRiskUsed += basePayout
 						}
-						if flightRiskUsed < flight.Risk {
-							bets[idx].Payout = payout
+						if flightRiskUsed < flightRisk {
+							bets[idx].Payout, bets[idx].PayoutMoney = fromMinor(payout, currency), money(payout, currency)
 						} else {
 							break
 						}
-						server.messaging.Send(messaging.EventMessage{
+						server.sendEvent(flyingCtx, messaging.EventMessage{
 							Service: "aviator",
 							Message: &bets[idx],
 							OrgId:   bets[idx].OrgID,
@@ -239,43 +362,66 @@ func (server *Server) initializePlane(orgID string) {
 						})
 					}
 
-					server.redis.Write(flightRedisKey, "$.multiplier", flight.Multiplier)
+					currentMultiplier.WithLabelValues(orgID).Set(flight.Multiplier)
+					flight.TickedAt = server.clock.Now().UnixMilli()
+					server.tickFlight(flight)
 
-					cashOutTarget := utils.RandInt(0, len(flight.LeaderBoard)-1)
-					if flight.Multiplier >= utils.RandFloat(1.03, 1.10*flight.Multiplier) {
-						if !flight.LeaderBoard[cashOutTarget].CashedOut {
-							flight.LeaderBoard[cashOutTarget].Multiplier = fmt.Sprintf("%.2fx", flight.Multiplier-0.01)
-							flight.LeaderBoard[cashOutTarget].CashedOut = cashOutTarget == utils.RandInt(0, len(flight.LeaderBoard)-1)
-							flight.LeaderBoard[cashOutTarget].PayOut = flight.LeaderBoard[cashOutTarget].Stake * flight.Multiplier
+					cashOutTarget := server.random.Int(0, len(flight.LeaderBoard)-1)
+					if flight.Multiplier >= server.random.Float(1.03, 1.10*flight.Multiplier) {
+						// an entry only changes when it cashes out, that is all a delta carries
+						if entry := flight.LeaderBoard[cashOutTarget]; !entry.CashedOut && cashOutTarget == server.random.Int(0, len(flight.LeaderBoard)-1) {
+							entry.CashedOut = true
+							entry.Multiplier = fmt.Sprintf("%.2fx", flight.Multiplier-0.01)
+							entry.PayOut = entry.Stake * flight.Multiplier
 						}
 					}
 
-					server.broadcastFlightState(flight)
+					server.broadcastFlightState(flyingCtx, flight)
 
 				}
 
-				if flightRiskUsed >= flight.Risk {
-					ctx := context.Background()
+				if flightRiskUsed >= flightRisk {
+					flying.SetAttributes(attribute.Float64("multiplier", flight.Multiplier-0.01))
+					flying.End()
+					ctx, settlement := startSpan(ctx, "round.settlement")
 					flight.State = STATE_EXPLODED
-					server.broadcastFlightState(flight)
-					planeHistoryRedisKey := fmt.Sprintf("%s-plane-history", flight.OrgID)
-					if flightsCount, err := server.redis.Client.LLen(ctx, planeHistoryRedisKey).Result(); err == nil && flightsCount >= 20 {
-						server.redis.Client.RPop(ctx, planeHistoryRedisKey)
+					// no cashout may land once players can see the explosion
+					server.sealBook(orgID, flight.ID)
+					roundsTotal.WithLabelValues(orgID).Inc()
+					openBets.WithLabelValues(orgID).Set(0)
+					currentMultiplier.WithLabelValues(orgID).Set(0)
+					server.broadcastFlightState(ctx, flight)
+					if err := server.historyStore.PushResult(ctx, orgID, fmt.Sprintf("%.2fx", flight.Multiplier-0.01)); err != nil {
+						server.planeFailed(orgID, err, "failed to write plane history")
 					}
-					server.redis.Client.LPush(ctx, planeHistoryRedisKey, fmt.Sprintf("%.2fx", flight.Multiplier-0.01))
+					server.drawJackpot(ctx, settings, flight)
 					if currentFlight, err := server.getFlightById(orgID, flight.ID); err == nil {
-						profitOnFlight := (currentFlight.Risk - currentFlight.ProfitBlown) * .5
-						server.db.UpdateOne(CLIENTS_COLLECTION, bson.M{"orgId": orgID}, bson.M{"$inc": bson.M{"reservedBalance": profitOnFlight, "amountToRisk": profitOnFlight}})
-						if flightbets := server.getPlaneBets(orgID, flight.ID, "$"); len(flightbets) > 0 {
-							server.db.InsertOne(FLIGHTS_COLLECTION, currentFlight)
-							if err := server.db.InsertMany(BETS_COLLECTION, flightbets); err != nil {
-								server.log.Err(err).Msg("failed to insert bets to db")
+						// the stored multiplier trails the loop until the next flush
+						currentFlight.Multiplier, currentFlight.TickedAt = flight.Multiplier, flight.TickedAt
+						// the profit is split evenly between the pools, an odd minor unit is dropped
+						if len(currentFlight.Exposures) == 0 {
+							currentFlight.Exposures = map[string]*aviator.CurrencyExposure{server.baseCurrency(settings): {
+								Risk:        server.moneyMinor(currentFlight.RiskMoney, currentFlight.Risk),
+								ProfitBlown: server.moneyMinor(currentFlight.ProfitBlownMoney, currentFlight.ProfitBlown),
+							}}
+						}
+						for currency, exposure := range currentFlight.Exposures {
+							profitOnFlight := (exposure.Risk - exposure.ProfitBlown) / 2
+							update := server.treasuryUpdate(settings, currency, "$inc", map[string]int64{"reservedBalance": profitOnFlight, "amountToRisk": profitOnFlight})
+							server.settingsStore.UpdateSettings(ctx, bson.M{"orgId": orgID}, update)
+						}
+						if flightbets := server.getPlaneBets(orgID, flight.ID); len(flightbets) > 0 {
+							if err := server.historyStore.ArchiveFlight(ctx, currentFlight, flightbets); err != nil {
+								server.planeFailed(orgID, err, "failed to insert bets to db")
 							}
 						}
 					}
-					server.redis.Client.Del(ctx, flightRedisKey)
-					server.redis.Client.Del(ctx, flightBetsRedisKey(orgID, flight.ID))
-					time.Sleep(time.Second * 4)
+					server.observeTreasury(orgID)
+					server.flightStore.DeleteFlight(ctx, orgID, flight.ID)
+					server.closeBook(orgID, flight.ID)
+					settlement.End()
+					round.End()
+					server.rounds.sleep(orgID, time.Second*4)
 					break
 				}
 			}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type cashbackKey struct {
+	userID   string
+	currency string
+}
+
+func cashbackID(orgID, userID, currency string, periodStart time.Time) string {
+	return fmt.Sprintf("%s-%s-%s-%d", orgID, userID, currency, periodStart.Unix())
+}
+
+func cashbackPeriodDays(settings *aviator.CashbackSettings) int64 {
+	if settings.GetPeriodDays() > 0 {
+		return settings.GetPeriodDays()
+	}
+	return CASHBACK_DEFAULT_PERIOD
+}
+
+// cashbackPeriod returns the period that contains now. Periods are counted from
+// the zero time, which was a monday, so weekly periods start on monday at 00:00 UTC.
+func cashbackPeriod(settings *aviator.CashbackSettings, now time.Time) (time.Time, time.Time) {
+	length := time.Duration(cashbackPeriodDays(settings)) * time.Hour * 24
+	start := now.UTC().Truncate(length)
+	return start, start.Add(length)
+}
+
+func cashbackAmount(settings *aviator.CashbackSettings, netLoss int64) int64 {
+	if netLoss <= 0 || netLoss < settings.GetMinLoss() {
+		return 0
+	}
+	return scaleMinor(netLoss, settings.GetPercentage()/100)
+}
+
+// netLosses sums what each user staked minus what they were paid on the live
+// bets of the period, per currency. Free bets cost the player nothing and are left out.
+func (server *Server) netLosses(orgID, userID string, start, end time.Time) (map[cashbackKey]int64, error) {
+	bets := []*aviator.PlaneBet{}
+	filter := bson.M{
+		"orgId":       orgID,
+		"account":     "live",
+		"freeBetId":   bson.M{"$in": []any{"", nil}},
+		"dateCreated": bson.M{"$gte": start.Unix(), "$lt": end.Unix()},
+	}
+	if userID != "" {
+		filter["userId"] = userID
+	}
+	if err := server.db.Find(BETS_COLLECTION, filter, &bets); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	settings := server.getPlaneSettings(orgID)
+	losses := map[cashbackKey]int64{}
+	for _, bet := range bets {
+		key := cashbackKey{userID: bet.UserID, currency: server.betCurrency(settings, bet)}
+		losses[key] += server.moneyMinor(bet.StakeMoney, bet.Stake) - server.moneyMinor(bet.PayoutMoney, bet.Payout)
+	}
+	return losses, nil
+}
+
+// payCashback queues the credit under the cashback id before recording the
+// cashback. The id is unique per user, currency and period, so a period that
+// was queued can never be paid again, and a record that failed to write after
+// its credit was queued is written on the next run.
+func (server *Server) payCashback(ctx context.Context, cashback *aviator.Cashback) error {
+	err := server.creditWallet(ctx, &aviator.WalletOp{
+		ID:          cashback.ID,
+		OrgID:       cashback.OrgID,
+		Target:      "live",
+		BetID:       cashback.ID,
+		UserID:      cashback.UserID,
+		Reason:      WALLET_REASON_CASHBACK,
+		Amount:      fromMinor(cashback.Amount, cashback.Currency),
+		AmountMoney: money(cashback.Amount, cashback.Currency),
+	})
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	if _, err := server.db.InsertOne(CASHBACKS_COLLECTION, cashback); err != nil && !mongo.IsDuplicateKeyError(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// settleCashback pays the cashback of every user with a net loss in the period
+// that ended before now.
+func (server *Server) settleCashback(settings *aviator.PlaneSettings, now time.Time) error {
+	current, _ := cashbackPeriod(settings.Cashback, now)
+	start := current.Add(-time.Duration(cashbackPeriodDays(settings.Cashback)) * time.Hour * 24)
+	losses, err := server.netLosses(settings.OrgID, "", start, current)
+	if err != nil {
+		return err
+	}
+	for key, netLoss := range losses {
+		amount := cashbackAmount(settings.Cashback, netLoss)
+		if amount == 0 {
+			continue
+		}
+		cashback := &aviator.Cashback{
+			Amount:      amount,
+			NetLoss:     netLoss,
+			UserID:      key.userID,
+			OrgID:       settings.OrgID,
+			Currency:    key.currency,
+			PeriodStart: start.Unix(),
+			PeriodEnd:   current.Unix(),
+			DateCreated: time.Now().Unix(),
+			ID:          cashbackID(settings.OrgID, key.userID, key.currency, start),
+		}
+		if err := server.payCashback(context.Background(), cashback); err != nil {
+			server.log.Err(err).Msgf("failed to credit cashback %s", cashback.ID)
+		}
+	}
+	return nil
+}
+
+// runCashback settles the previous period for every org with cashback enabled.
+func (server *Server) runCashback() {
+	ticker := time.NewTicker(CASHBACK_EVERY)
+	for ; ; <-ticker.C {
+		clients, err := server.settingsStore.ListSettings(context.Background(), bson.M{"cashback.enabled": true})
+		if err != nil {
+			server.log.Err(err).Msg("failed to read clients for cashback")
+			continue
+		}
+		for _, client := range clients {
+			if !server.ownsRounds(client.OrgID) {
+				continue
+			}
+			if err := server.settleCashback(client, time.Now()); err != nil {
+				server.log.Err(err).Msgf("failed to settle cashback for org %s", client.OrgID)
+			}
+		}
+	}
+}
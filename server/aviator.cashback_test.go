@@ -0,0 +1,30 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thedivinez/go-libs/services/aviator"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCashbackIsPaidOnce(t *testing.T) {
+	h := newHarness(t, "frank")
+	cashback := &aviator.Cashback{ID: cashbackID(testOrg, "frank", "USD", time.Unix(0, 0)), OrgID: testOrg, UserID: "frank", Currency: "USD", Amount: 250}
+	// the credit is queued but the record never made it
+	if err := h.server.creditWallet(context.Background(), &aviator.WalletOp{ID: cashback.ID, OrgID: testOrg, UserID: "frank", Target: "live", Reason: WALLET_REASON_CASHBACK, Amount: 2.5, AmountMoney: money(250, "USD")}); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := h.server.payCashback(context.Background(), cashback); err != nil {
+			t.Fatalf("failed to pay cashback: %v", err)
+		}
+	}
+	if got := h.auth.balance(t, "frank"); got != 102.5 {
+		t.Fatalf("cashback should be credited once, frank has %v", got)
+	}
+	if err := h.server.db.FindOne(CASHBACKS_COLLECTION, bson.M{"_id": cashback.ID}, &aviator.Cashback{}); err != nil {
+		t.Fatalf("the cashback should be recorded: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/thedivinez/go-libs/messaging"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"github.com/thedivinez/go-libs/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var chatLinkPattern = regexp.MustCompile(`(?i)(https?://|www\.|\b[a-z0-9-]+\.(com|net|org|io|co|me|gg|xyz|ru|info|biz|bet|link|ly)\b)`)
+
+// chatBlockedWords are masked in every message, matching whole words only.
+var chatBlockedWords = regexp.MustCompile(`(?i)\b(fuck\w*|shit\w*|bitch\w*|cunt\w*|asshole\w*|bastard\w*|dick\w*|nigg\w*|fag\w*|whore\w*|slut\w*)\b`)
+
+func chatHistoryRedisKey(orgID string) string {
+	return fmt.Sprintf("%s-plane:chat", orgID)
+}
+
+func chatRateRedisKey(orgID, userID string) string {
+	return fmt.Sprintf("%s-chat:rate-%s", orgID, userID)
+}
+
+func chatMutedRedisKey(orgID, userID string) string {
+	return fmt.Sprintf("%s-chat:muted-%s", orgID, userID)
+}
+
+func chatBannedRedisKey(orgID, userID string) string {
+	return fmt.Sprintf("%s-chat:banned-%s", orgID, userID)
+}
+
+// filterChatText rejects links and masks blocked words.
+func filterChatText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", utils.NewServiceError(http.StatusBadRequest, "message is empty")
+	}
+	if utf8.RuneCountInString(text) > CHAT_MAX_LENGTH {
+		return "", utils.NewServiceError(http.StatusBadRequest, fmt.Sprintf("message must be at most %d characters", CHAT_MAX_LENGTH))
+	}
+	if chatLinkPattern.MatchString(text) {
+		return "", utils.NewServiceError(http.StatusBadRequest, "links are not allowed in chat")
+	}
+	return chatBlockedWords.ReplaceAllStringFunc(text, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	}), nil
+}
+
+// checkChatAccess fails for banned and muted players and for players that sent
+// more than the allowed messages in a window.
+func (server *Server) checkChatAccess(ctx context.Context, orgID, userID string) error {
+	if banned, _, _ := server.chatStore.Restriction(ctx, orgID, userID, CHAT_BAN); banned {
+		return utils.NewServiceError(http.StatusForbidden, "you are banned from chat")
+	}
+	if muted, left, err := server.chatStore.Restriction(ctx, orgID, userID, CHAT_MUTE); err == nil && muted {
+		return utils.NewServiceError(http.StatusForbidden, fmt.Sprintf("you are muted for %s", left.Round(time.Second)))
+	}
+	// the bucket holds the messages of a window and refills over the window
+	bucket := tokenBucket{chatRateRedisKey(orgID, userID), CHAT_RATE_LIMIT, float64(CHAT_RATE_LIMIT) / CHAT_RATE_WINDOW.Seconds()}
+	allowed, _, err := server.limitStore.TakeToken(ctx, []tokenBucket{bucket})
+	if err != nil {
+		return utils.NewServiceError(http.StatusInternalServerError, "failed to send message").WithInternal(err)
+	}
+	if !allowed {
+		return utils.NewServiceError(http.StatusTooManyRequests, "you are sending messages too fast")
+	}
+	return nil
+}
+
+// betCard renders a settled winning bet of the player for sharing in chat.
+func (server *Server) betCard(orgID, userID, betID string) (*aviator.BetCard, error) {
+	bet := &aviator.PlaneBet{}
+	if err := server.db.FindOne(BETS_COLLECTION, bson.M{"_id": betID, "orgId": orgID, "userId": userID}, bet); err != nil {
+		return nil, utils.NewServiceError(http.StatusNotFound, "bet not found").WithInternal(err)
+	}
+	stake, payout := server.moneyMinor(bet.StakeMoney, bet.Stake), server.moneyMinor(bet.PayoutMoney, bet.Payout)
+	if payout <= 0 || stake <= 0 {
+		return nil, utils.NewServiceError(http.StatusBadRequest, "only cashed out bets can be shared")
+	}
+	return &aviator.BetCard{
+		Stake:      stake,
+		Payout:     payout,
+		BetID:      bet.BetId,
+		Currency:   server.betCurrency(server.getPlaneSettings(orgID), bet),
+		Multiplier: float64(payout*100/stake) / 100,
+	}, nil
+}
+
+// publishChatMessage keeps the last messages of the room and sends the message
+// to everyone in the plane room.
+func (server *Server) publishChatMessage(ctx context.Context, message *aviator.ChatMessage) error {
+	if err := server.chatStore.PushMessage(ctx, message); err != nil {
+		return err
+	}
+	server.sendEvent(ctx, messaging.EventMessage{
+		Room:    "plane",
+		Service: "aviator",
+		OrgId:   message.OrgID,
+		Event:   "chat:message",
+		Message: message,
+	})
+	return nil
+}
+
+func (server *Server) chatHistory(ctx context.Context, orgID string, limit int64) ([]*aviator.ChatMessage, error) {
+	if limit <= 0 || limit > CHAT_HISTORY_SIZE {
+		limit = CHAT_HISTORY_SIZE
+	}
+	return server.chatStore.GetMessages(ctx, orgID, limit)
+}
+
+var chatActions = []string{CHAT_MUTE, CHAT_UNMUTE, CHAT_BAN, CHAT_UNBAN}
+
+func (server *Server) moderateChat(ctx context.Context, req *aviator.ModerateChatRequest) error {
+	switch req.Action {
+	case CHAT_MUTE:
+		duration := time.Duration(req.Duration) * time.Second
+		if duration <= 0 {
+			duration = CHAT_DEFAULT_MUTE
+		}
+		return server.chatStore.Restrict(ctx, req.OrgID, req.UserID, CHAT_MUTE, duration)
+	case CHAT_UNMUTE:
+		return server.chatStore.Lift(ctx, req.OrgID, req.UserID, CHAT_MUTE)
+	case CHAT_BAN:
+		return server.chatStore.Restrict(ctx, req.OrgID, req.UserID, CHAT_BAN, 0)
+	case CHAT_UNBAN:
+		return server.chatStore.Lift(ctx, req.OrgID, req.UserID, CHAT_BAN)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package server
+
+import (
+	"context"
+	"testing"
+)
+
+func TestChatIsRateLimited(t *testing.T) {
+	h := newHarness(t)
+	for idx := range CHAT_RATE_LIMIT + 1 {
+		err := h.server.checkChatAccess(context.Background(), testOrg, "hana")
+		if idx < CHAT_RATE_LIMIT && err != nil {
+			t.Fatalf("message %d should be allowed: %v", idx, err)
+		}
+		if idx == CHAT_RATE_LIMIT && err == nil {
+			t.Fatal("a message over the limit should be refused")
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"time"
+
+	"github.com/thedivinez/go-libs/utils"
+)
+
+// Clock is the time source of the flight loop, tests replace it to drive rounds.
+type Clock interface {
+	Now() time.Time
+	NewTicker(interval time.Duration) Ticker
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Random draws the numbers that shape a round. Int returns a number in [min, max).
+type Random interface {
+	Float(min, max float64) float64
+	Int(min, max int) int
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTicker(interval time.Duration) Ticker {
+	return systemTicker{time.NewTicker(interval)}
+}
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (ticker systemTicker) C() <-chan time.Time { return ticker.ticker.C }
+
+func (ticker systemTicker) Stop() { ticker.ticker.Stop() }
+
+type systemRandom struct{}
+
+func (systemRandom) Float(min, max float64) float64 { return utils.RandFloat(min, max) }
+
+func (systemRandom) Int(min, max int) int { return utils.RandInt(min, max) }
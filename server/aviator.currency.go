@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/pkg/errors"
+
+	"github.com/thedivinez/go-libs/services/aviator"
+	"github.com/thedivinez/go-libs/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func money(minor int64, currency string) *aviator.Money {
+	return &aviator.Money{Minor: minor, Currency: currency}
+}
+
+func (server *Server) baseCurrency(settings *aviator.PlaneSettings) string {
+	if settings.BaseCurrency != "" {
+		return settings.BaseCurrency
+	}
+	return server.config.Currency
+}
+
+func (server *Server) betCurrency(settings *aviator.PlaneSettings, bet *aviator.PlaneBet) string {
+	if bet.Currency != "" {
+		return bet.Currency
+	}
+	if bet.StakeMoney.GetCurrency() != "" {
+		return bet.StakeMoney.GetCurrency()
+	}
+	return server.baseCurrency(settings)
+}
+
+// toBase converts an amount to the org's base currency. Rates are the value of
+// one unit of the currency in the base currency. A currency without a rate
+// cannot be valued and is an error, never 1:1.
+func (server *Server) toBase(settings *aviator.PlaneSettings, minor int64, currency string) (int64, error) {
+	base := server.baseCurrency(settings)
+	if currency == base {
+		return minor, nil
+	}
+	rate, ok := settings.ExchangeRates[currency]
+	if !ok || rate <= 0 {
+		return 0, errors.Errorf("no exchange rate from %s to %s", currency, base)
+	}
+	return scaleMinor(minor, rate*minorScale(base)/minorScale(currency)), nil
+}
+
+func (server *Server) fromBase(settings *aviator.PlaneSettings, minor int64, currency string) (int64, error) {
+	base := server.baseCurrency(settings)
+	if currency == base {
+		return minor, nil
+	}
+	rate, ok := settings.ExchangeRates[currency]
+	if !ok || rate <= 0 {
+		return 0, errors.Errorf("no exchange rate from %s to %s", currency, base)
+	}
+	return scaleMinor(minor, minorScale(currency)/(rate*minorScale(base))), nil
+}
+
+func (server *Server) validateBetCurrency(settings *aviator.PlaneSettings, currency string, stake int64) error {
+	allowed := settings.Currencies
+	if len(allowed) == 0 {
+		allowed = []string{server.baseCurrency(settings)}
+	}
+	if !slices.Contains(allowed, currency) {
+		return utils.NewServiceError(http.StatusBadRequest, fmt.Sprintf("bets in %s are not accepted", currency))
+	}
+	if _, err := server.toBase(settings, stake, currency); err != nil {
+		return utils.NewServiceError(http.StatusBadRequest, fmt.Sprintf("bets in %s are not accepted", currency)).WithInternal(err)
+	}
+	if limits, ok := settings.StakeLimits[currency]; ok {
+		if stake < limits.MinStake {
+			return utils.NewServiceError(http.StatusBadRequest, "minimum stake is "+formatMoney(limits.MinStake, currency))
+		}
+		if limits.MaxStake > 0 && stake > limits.MaxStake {
+			return utils.NewServiceError(http.StatusBadRequest, "maximum stake is "+formatMoney(limits.MaxStake, currency))
+		}
+	}
+	return nil
+}
+
+// treasuryBalances reads the pool of a currency. Orgs that have not been
+// migrated yet only have the legacy pool, which is in the base currency.
+func (server *Server) treasuryBalances(settings *aviator.PlaneSettings, currency string) (int64, int64) {
+	if treasury, ok := settings.Treasuries[currency]; ok {
+		return treasury.AmountToRisk, treasury.ReservedBalance
+	}
+	if currency == server.baseCurrency(settings) {
+		return server.moneyMinor(settings.AmountToRiskMoney, settings.AmountToRisk), server.moneyMinor(settings.ReservedBalanceMoney, settings.ReservedBalance)
+	}
+	return 0, 0
+}
+
+// treasuryUpdate writes treasury movements to the pool of a currency, and keeps
+// the legacy fields in step when the currency is the base currency.
+func (server *Server) treasuryUpdate(settings *aviator.PlaneSettings, currency, op string, amounts map[string]int64) bson.M {
+	update := bson.M{}
+	for field, minor := range amounts {
+		update[fmt.Sprintf("treasuries.%s.%s", currency, field)] = minor
+		if currency == server.baseCurrency(settings) {
+			update[field] = fromMinor(minor, currency)
+			update[field+"Money.minor"] = minor
+		}
+	}
+	return bson.M{op: update}
+}
+
+// fundFlightRisk takes the extra risk for a round from the pool of its currency,
+// first from the amount to risk, then from the reserve, then from both. The
+// flight's settings only fix the game, the pools are read live and drawn with
+// $inc on the balances that were read, so a movement that lands in between
+// makes it read again. It returns the amount it could fund, which is zero when
+// the pools are too low.
+func (server *Server) fundFlightRisk(settings *aviator.PlaneSettings, currency string, riskAmount int64) int64 {
+	ctx := context.Background()
+	for attempt := 0; attempt < TREASURY_FUND_ATTEMPTS; attempt++ {
+		live, err := server.settingsStore.GetSettings(ctx, settings.OrgID)
+		if err != nil {
+			server.log.Err(err).Msgf("failed to read the treasury of org %s", settings.OrgID)
+			return 0
+		}
+		amountToRisk, reservedBalance := server.treasuryBalances(live, currency)
+		var amounts map[string]int64
+		if riskAmount <= amountToRisk {
+			amounts = map[string]int64{"amountToRisk": -riskAmount}
+		} else if riskAmount <= reservedBalance {
+			amounts = map[string]int64{"reservedBalance": -riskAmount}
+		} else if riskAmount <= (reservedBalance + amountToRisk) {
+			amounts = map[string]int64{"amountToRisk": reservedBalance - riskAmount, "reservedBalance": -reservedBalance}
+		} else {
+			return 0
+		}
+		filter := bson.M{
+			"orgId": settings.OrgID,
+			fmt.Sprintf("treasuries.%s.amountToRisk", currency):    amountToRisk,
+			fmt.Sprintf("treasuries.%s.reservedBalance", currency): reservedBalance,
+		}
+		update := server.treasuryUpdate(live, currency, "$inc", amounts)
+		revision := primitive.NewObjectID().Hex()
+		update["$set"] = bson.M{"revision": revision}
+		if err := server.settingsStore.UpdateSettings(ctx, filter, update); err != nil {
+			server.log.Err(err).Msgf("failed to fund flight risk for org %s", settings.OrgID)
+			return 0
+		}
+		if written, err := server.settingsStore.GetRevision(ctx, settings.OrgID); err == nil && written == revision {
+			return riskAmount
+		}
+	}
+	return 0
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/thedivinez/go-libs/services/aviator"
+)
+
+func TestCurrenciesNeedARate(t *testing.T) {
+	h := newHarness(t)
+	current, err := h.server.settingsStore.GetSettings(context.Background(), testOrg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the org has no base currency of its own, the service's still needs a rate
+	if _, err := h.server.updatePlaneSettings(asPlatform(), &aviator.PlaneSettings{OrgID: testOrg, Version: current.Version, Currencies: []string{"USD", "JPY"}}); err == nil {
+		t.Fatal("a currency without a rate should be refused")
+	}
+	settings := &aviator.PlaneSettings{ExchangeRates: map[string]float64{"JPY": 0.0067, "KWD": 3.25}}
+	for _, check := range []struct {
+		currency string
+		minor    int64
+		base     int64
+	}{{"JPY", 1000, 670}, {"KWD", 1000, 325}} {
+		if got, err := h.server.toBase(settings, check.minor, check.currency); err != nil || got != check.base {
+			t.Fatalf("%d %s should be %d cents, got %d (%v)", check.minor, check.currency, check.base, got, err)
+		}
+	}
+	if _, err := h.server.toBase(settings, 1000, "EUR"); err == nil {
+		t.Fatal("a currency without a rate should not convert")
+	}
+}
+
+func TestRiskIsFundedFromTheLiveTreasury(t *testing.T) {
+	h := newHarness(t)
+	flightSettings, err := h.server.settingsStore.GetSettings(context.Background(), testOrg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the pools moved after the flight took its settings
+	if _, err := h.server.adjustTreasury(asPlatform(), &aviator.AdjustTreasuryRequest{OrgID: testOrg, Currency: "USD", AmountToRisk: -999_900, ReservedBalance: 500}); err != nil {
+		t.Fatal(err)
+	}
+	if funded := h.server.fundFlightRisk(flightSettings, "USD", 300); funded != 300 {
+		t.Fatalf("the reserve should fund 300, got %d", funded)
+	}
+	if treasury := h.treasury(); treasury.AmountToRisk != 100 || treasury.ReservedBalance != 200 {
+		t.Fatalf("the risk should come from the reserve, the pools hold %d and %d", treasury.AmountToRisk, treasury.ReservedBalance)
+	}
+	if funded := h.server.fundFlightRisk(flightSettings, "USD", 250); funded != 250 {
+		t.Fatalf("both pools should fund 250, got %d", funded)
+	}
+	if treasury := h.treasury(); treasury.AmountToRisk != 50 || treasury.ReservedBalance != 0 {
+		t.Fatalf("the risk should empty the reserve first, the pools hold %d and %d", treasury.AmountToRisk, treasury.ReservedBalance)
+	}
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/thedivinez/go-libs/services/auth"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRoundSettlesCashoutsAndExplosion(t *testing.T) {
+	h := startHarness(t, "alice", "bob")
+	loading := h.advanceUntil("loading", inState(STATE_LOADING))
+
+	alice := h.placeBet("alice", "left", 10)
+	bob := h.placeBet("bob", "left", 20)
+	if alice.Status != "open" || alice.FlightID != loading.ID || bob.FlightID != loading.ID {
+		t.Fatalf("bets during loading should ride the loading flight, got %+v and %+v", alice, bob)
+	}
+	if got := h.auth.balance(t, "alice"); got != 90 {
+		t.Fatalf("alice should have been debited to 90, has %v", got)
+	}
+
+	// the 30 staked plus 20% of it from the treasury is the round's risk
+	h.advanceUntil("flight at 1.05x", func(flight *aviator.FlightState) bool {
+		return flight.ID == loading.ID && flight.State == STATE_FLYING && flight.Multiplier >= "1.05x"
+	})
+	if _, err := h.client.PlaneCashout(h.as("alice"), &aviator.PlaneBet{BetId: alice.BetId, FlightID: alice.FlightID}); err != nil {
+		t.Fatalf("alice failed to cash out: %v", err)
+	}
+	flight, err := h.server.flightStore.GetFlight(context.Background(), testOrg, loading.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alicePayout := fromMinor(flight.ProfitBlownMoney.GetMinor(), "USD")
+	if alicePayout < 10.5 || h.auth.balance(t, "alice") != 90+alicePayout {
+		t.Fatalf("alice should have been paid at least 10.5, paid %v and has %v", alicePayout, h.auth.balance(t, "alice"))
+	}
+	if _, err := h.client.PlaneCashout(h.as("alice"), &aviator.PlaneBet{BetId: alice.BetId, FlightID: alice.FlightID}); status.Code(err) == codes.OK {
+		t.Fatal("a bet should only cash out once")
+	}
+
+	// bob's 20 at 1.80x uses up the 36 of risk
+	exploded := h.advanceUntil("explosion", inState(STATE_EXPLODED))
+	if exploded.ID != loading.ID || exploded.Multiplier != "1.79x" {
+		t.Fatalf("flight %s should explode after 1.79x, exploded %s at %s", loading.ID, exploded.ID, exploded.Multiplier)
+	}
+	if _, err := h.client.PlaneCashout(h.as("bob"), &aviator.PlaneBet{BetId: bob.BetId, FlightID: bob.FlightID}); status.Code(err) == codes.OK {
+		t.Fatal("a bet should not cash out once the plane has exploded")
+	}
+	if got := h.auth.balance(t, "bob"); got != 80 {
+		t.Fatalf("bob should have lost his stake, has %v", got)
+	}
+
+	history, err := h.client.GetPlaneHistory(context.Background(), &aviator.GetPlaneHistoryRequest{OrgID: testOrg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(history.History, []string{"1.79x"}) {
+		t.Fatalf("history should hold the explosion, has %v", history.History)
+	}
+
+	profit := (3600 - flight.ProfitBlownMoney.GetMinor()) / 2
+	h.eventually("treasury settlement", func() bool {
+		treasury := h.treasury()
+		return treasury.ReservedBalance == profit && treasury.AmountToRisk == 1_000_000-600+profit
+	})
+	h.eventually("archived bets", func() bool {
+		bets, err := h.client.GetPlaneBets(h.as("bob"), &aviator.GetPlaneBetsRequest{Page: "1", Limit: 10})
+		return err == nil && len(bets.Bets) == 1 && bets.Bets[0].BetId == bob.BetId
+	})
+	h.eventually("archived cashout", func() bool {
+		bets, err := h.client.GetPlaneBets(h.as("alice"), &aviator.GetPlaneBetsRequest{Page: "1", Limit: 10})
+		return err == nil && len(bets.Bets) == 1 && bets.Bets[0].Status == "cashedout" && bets.Bets[0].Payout == alicePayout
+	})
+
+	// the ledger holds what the bets say, a movement no bet explains is reported
+	report, err := h.server.reconcileDay(context.Background(), testOrg, h.clock.Now())
+	if err != nil || report.Bets != 2 || len(report.Items) != 0 || report.TotalDebited != 30 || report.TotalCredited != alicePayout {
+		t.Fatalf("the day should reconcile, got %v (%v)", report, err)
+	}
+	h.auth.Lock()
+	h.auth.ledger = append(h.auth.ledger, &auth.LedgerEntry{OrgID: testOrg, UserId: "bob", Amount: 5, Target: "live", Source: "aviator", IdempotencyKey: "unknown", DateCreated: h.clock.Now().Unix()})
+	h.auth.Unlock()
+	if report, err := h.server.reconcileDay(context.Background(), testOrg, h.clock.Now()); err != nil || len(report.Items) != 1 || report.Items[0].Kind != "orphan" {
+		t.Fatalf("an unknown movement should be an orphan, got %v (%v)", report, err)
+	}
+}
+
+func TestWaitingBetCanBeCanceled(t *testing.T) {
+	h := startHarness(t, "carol")
+	loading := h.advanceUntil("loading", inState(STATE_LOADING))
+	h.advanceUntil("flight", inState(STATE_FLYING))
+
+	// once the plane is up, bets go to the next flight until it starts loading
+	bet := h.placeBet("carol", "right", 5)
+	if bet.Status != "waiting" || bet.FlightID == loading.ID {
+		t.Fatalf("bet should wait for the next flight, got %+v", bet)
+	}
+	replicated := func(count int) func() bool {
+		return func() bool {
+			bets, err := h.server.betStore.GetBets(context.Background(), testOrg, bet.FlightID)
+			return err == nil && len(bets) == count
+		}
+	}
+	h.eventually("bet written behind", replicated(1))
+	active, err := h.client.GetActiveBets(h.as("carol"), &aviator.GetActiveBetsRequest{})
+	if err != nil || len(active.Bets) != 1 {
+		t.Fatalf("waiting bet should be active, got %v (%v)", active, err)
+	}
+	if _, err := h.client.CancelPlaneBet(h.as("carol"), &aviator.PlaneBet{BetId: bet.BetId, FlightID: bet.FlightID}); err != nil {
+		t.Fatalf("failed to cancel the waiting bet: %v", err)
+	}
+	if got := h.auth.balance(t, "carol"); got != 100 {
+		t.Fatalf("canceled stake should be refunded, carol has %v", got)
+	}
+	if _, err := h.client.CancelPlaneBet(h.as("carol"), &aviator.PlaneBet{BetId: bet.BetId, FlightID: bet.FlightID}); status.Code(err) == codes.OK {
+		t.Fatal("a bet should only be refunded once")
+	}
+	if active, err := h.client.GetActiveBets(h.as("carol"), &aviator.GetActiveBetsRequest{}); err != nil || len(active.Bets) != 0 {
+		t.Fatalf("canceled bet should not be active, got %v (%v)", active, err)
+	}
+	h.eventually("cancel written behind", replicated(0))
+}
+
+func TestOnlyTheRoundsOwnerTakesBets(t *testing.T) {
+	h := startHarness(t, "ivan")
+	h.advanceUntil("loading", inState(STATE_LOADING))
+	bet := h.placeBet("ivan", "left", 5)
+	if claimed, err := h.server.flightStore.ClaimRounds(context.Background(), testOrg, "other", ROUND_LEASE_TTL); err != nil || claimed {
+		t.Fatalf("another instance should not take rounds that are held (%v)", err)
+	}
+	h.eventually("bet written behind", func() bool {
+		bets, err := h.server.betStore.GetUserBets(context.Background(), testOrg, "ivan")
+		return err == nil && len(bets) == 1
+	})
+
+	// without the lease and the books the instance is like any other one
+	h.server.leases.Lock()
+	delete(h.server.leases.orgs, testOrg)
+	h.server.leases.Unlock()
+	h.server.dropBooks(testOrg)
+	active, err := h.client.GetActiveBets(h.as("ivan"), &aviator.GetActiveBetsRequest{})
+	if err != nil || len(active.Bets) != 1 || active.Bets[0].BetId != bet.BetId {
+		t.Fatalf("active bets should be read from the bet store, got %v (%v)", active, err)
+	}
+	if _, err := h.client.PlaneCashout(h.as("ivan"), &aviator.PlaneBet{BetId: bet.BetId, FlightID: bet.FlightID}); err == nil {
+		t.Fatal("a cashout should be turned away by an instance that does not run the rounds")
+	}
+	if _, err := h.client.PlacePlaneBet(h.as("ivan"), &aviator.PlaneBet{Side: "right", Stake: 5, Account: "live"}); err == nil || h.auth.balance(t, "ivan") != 95 {
+		t.Fatal("a bet should be turned away by an instance that does not run the rounds")
+	}
+}
+
+func TestBetsAreForwardedToTheRoundsOwner(t *testing.T) {
+	h := startHarness(t, "judy")
+	h.advanceUntil("loading", inState(STATE_LOADING))
+	peer := h.peer()
+	placed, err := peer.PlacePlaneBet(h.as("judy"), &aviator.PlaneBet{Side: "left", Stake: 5, Account: "live"})
+	if err != nil {
+		t.Fatalf("a bet placed on another instance should reach the owner: %v", err)
+	}
+	if bets := h.server.getPlaneBets(testOrg, placed.Bet.FlightID); len(bets) != 1 || bets[0].BetId != placed.Bet.BetId {
+		t.Fatal("the bet should be in the owner's book")
+	}
+	h.advanceUntil("takeoff", func(state *aviator.FlightState) bool {
+		return state.ID == placed.Bet.FlightID && state.State == STATE_FLYING
+	})
+	if _, err := peer.PlaneCashout(h.as("judy"), &aviator.PlaneBet{BetId: placed.Bet.BetId, FlightID: placed.Bet.FlightID}); err != nil {
+		t.Fatalf("a cashout on another instance should reach the owner: %v", err)
+	}
+	if got := h.auth.balance(t, "judy"); got < 100 {
+		t.Fatalf("judy should be paid out, has %v", got)
+	}
+}
+
+func TestPlayerNeedsSession(t *testing.T) {
+	h := startHarness(t, "dave")
+	h.advanceUntil("loading", inState(STATE_LOADING))
+	_, err := h.client.PlacePlaneBet(h.as("mallory"), &aviator.PlaneBet{Side: "left", Stake: 1, Account: "live"})
+	if err == nil {
+		t.Fatal("a bet without a valid session should be refused")
+	}
+	if _, err := h.client.PlacePlaneBet(context.Background(), &aviator.PlaneBet{Side: "left", Stake: 1, Account: "live"}); err == nil {
+		t.Fatal("a bet without a token should be refused")
+	}
+	if got := h.auth.balance(t, "dave"); got != 100 {
+		t.Fatalf("refused bets should not touch balances, dave has %v", got)
+	}
+}
+
+func TestFlightStateIsSentAsDeltas(t *testing.T) {
+	h := startHarness(t, "erin")
+	loading := h.advanceUntil("loading", inState(STATE_LOADING))
+	if len(loading.LeaderBoard) == 0 {
+		t.Fatal("the loading snapshot should carry the leaderboard")
+	}
+	flying := h.advanceUntil("flight at 1.20x", func(flight *aviator.FlightState) bool {
+		return flight.State == STATE_FLYING && flight.Multiplier >= "1.20x"
+	})
+	// only the start of loading and take off carry the whole state
+	if snapshots, deltas := h.messenger.count("flight:state"), h.messenger.count("flight:delta"); snapshots != 2 || deltas < 20 {
+		t.Fatalf("expected 2 snapshots and the rest as deltas, got %d and %d", snapshots, deltas)
+	}
+	joined, err := h.client.GetFlightState(context.Background(), &aviator.GetFlightStateRequest{OrgID: testOrg})
+	if err != nil {
+		t.Fatalf("failed to get the flight state: %v", err)
+	}
+	if !proto.Equal(joined, flying) {
+		t.Fatalf("a joining client should see what the others know, got %v want %v", joined, flying)
+	}
+}
+
+func TestJackpotTakesStakesThatFly(t *testing.T) {
+	h := startHarness(t, "erin")
+	h.advanceUntil("loading", inState(STATE_LOADING))
+	h.advanceUntil("flight", inState(STATE_FLYING))
+	rules := bson.M{"$set": bson.M{"jackpot": &aviator.JackpotSettings{Enabled: true, ContributionPercentage: 10, SeedAmount: 1000}}}
+	if err := h.server.settingsStore.UpdateSettings(context.Background(), bson.M{"orgId": testOrg}, rules); err != nil {
+		t.Fatal(err)
+	}
+	before := h.treasury().AmountToRisk
+
+	canceled := h.placeBet("erin", "left", 5)
+	if _, err := h.client.CancelPlaneBet(h.as("erin"), &aviator.PlaneBet{BetId: canceled.BetId, FlightID: canceled.FlightID}); err != nil {
+		t.Fatalf("failed to cancel: %v", err)
+	}
+	bet := h.placeBet("erin", "left", 5)
+	h.advanceUntil("next flight", func(state *aviator.FlightState) bool {
+		return state.ID == bet.FlightID && state.State == STATE_FLYING
+	})
+	jackpot, err := h.client.GetJackpot(context.Background(), &aviator.GetJackpotRequest{OrgID: testOrg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the seed and a tenth of the stake that flew, nothing from the canceled one
+	if jackpot.Amount != 1000+50 {
+		t.Fatalf("jackpot should hold 1050, got %d", jackpot.Amount)
+	}
+	if after := h.treasury().AmountToRisk; after > before-1000 {
+		t.Fatalf("the seed should come from the treasury, it went from %d to %d", before, after)
+	}
+}
+
+func TestBetsInFlightCannotBeCanceled(t *testing.T) {
+	h := startHarness(t, "fred")
+	h.advanceUntil("flight", inState(STATE_FLYING))
+	rules := bson.M{"$set": bson.M{"jackpot": &aviator.JackpotSettings{Enabled: true, ContributionPercentage: 10, SeedAmount: 1000}}}
+	if err := h.server.settingsStore.UpdateSettings(context.Background(), bson.M{"orgId": testOrg}, rules); err != nil {
+		t.Fatal(err)
+	}
+	jackpot := func() int64 {
+		jackpot, err := h.client.GetJackpot(context.Background(), &aviator.GetJackpotRequest{OrgID: testOrg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jackpot.Amount
+	}
+	pools := func() int64 {
+		treasury := h.treasury()
+		return treasury.AmountToRisk + treasury.ReservedBalance
+	}
+	startPools := pools()
+
+	bet := h.placeBet("fred", "left", 5)
+	h.advanceUntil("takeoff", func(state *aviator.FlightState) bool {
+		return state.ID == bet.FlightID && state.State == STATE_FLYING
+	})
+	flyingPools, flyingJackpot := pools(), jackpot()
+	if _, err := h.client.CancelPlaneBet(h.as("fred"), &aviator.PlaneBet{BetId: bet.BetId, FlightID: bet.FlightID}); err == nil {
+		t.Fatal("a bet should not be canceled once the plane took off")
+	}
+	if pools() != flyingPools || jackpot() != flyingJackpot {
+		t.Fatal("a refused cancel should leave the treasury and the jackpot alone")
+	}
+
+	h.advanceUntil("explosion", func(state *aviator.FlightState) bool {
+		return state.ID == bet.FlightID && state.State == STATE_EXPLODED
+	})
+	// the stake is counted once, a tenth in the jackpot seeded from the pools
+	// and the rest in the pools
+	h.eventually("the stake to be settled", func() bool {
+		return jackpot() == 1000+50 && pools()-startPools == 450-1000
+	})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/thedivinez/go-libs/services/aviator"
+	"github.com/thedivinez/go-libs/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// findFreeBet returns an available, unexpired free bet of the user.
+func (server *Server) findFreeBet(orgID, userID, freeBetID string) (*aviator.FreeBet, error) {
+	freeBet := &aviator.FreeBet{}
+	filter := bson.M{"_id": freeBetID, "orgId": orgID, "userId": userID, "status": FREE_BET_AVAILABLE}
+	if err := server.db.FindOne(FREE_BETS_COLLECTION, filter, freeBet); err != nil {
+		return nil, utils.NewServiceError(http.StatusNotFound, "free bet is not available").WithInternal(err)
+	}
+	if freeBet.ExpiresAt > 0 && time.Now().Unix() > freeBet.ExpiresAt {
+		return nil, utils.NewServiceError(http.StatusForbidden, "free bet has expired")
+	}
+	return freeBet, nil
+}
+
+// claimFreeBet marks the free bet as used by bet, failing when another bet
+// claimed it first.
+func (server *Server) claimFreeBet(bet *aviator.PlaneBet) error {
+	filter := bson.M{"_id": bet.FreeBetID, "userId": bet.UserID, "status": FREE_BET_AVAILABLE}
+	update := bson.M{"$set": bson.M{"status": FREE_BET_USED, "betId": bet.BetId, "dateUsed": time.Now().Unix()}}
+	if err := server.db.UpdateOne(FREE_BETS_COLLECTION, filter, update); err != nil {
+		return utils.NewServiceError(http.StatusInternalServerError, "failed to use free bet").WithInternal(err)
+	}
+	claimed := &aviator.FreeBet{}
+	if err := server.db.FindOne(FREE_BETS_COLLECTION, bson.M{"_id": bet.FreeBetID}, claimed); err != nil || claimed.BetID != bet.BetId {
+		return utils.NewServiceError(http.StatusConflict, "free bet has already been used")
+	}
+	return nil
+}
+
+// releaseFreeBet gives a free bet back to the player when its bet is canceled
+// or could not be placed.
+func (server *Server) releaseFreeBet(bet *aviator.PlaneBet) {
+	filter := bson.M{"_id": bet.FreeBetID, "betId": bet.BetId}
+	update := bson.M{"$set": bson.M{"status": FREE_BET_AVAILABLE, "betId": "", "dateUsed": 0}}
+	if err := server.db.UpdateOne(FREE_BETS_COLLECTION, filter, update); err != nil {
+		server.log.Err(err).Msgf("failed to release free bet %s", bet.FreeBetID)
+	}
+}
+
+// freeBetWinnings is what a free bet credits on cashout, the winnings without
+// the stake that was never debited.
+func freeBetWinnings(payout, stake int64) int64 {
+	return max(payout-stake, 0)
+}
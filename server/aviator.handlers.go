@@ -4,8 +4,10 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"slices"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/thedivinez/go-libs/messaging"
 	"github.com/thedivinez/go-libs/services/auth"
 	"github.com/thedivinez/go-libs/services/aviator"
@@ -15,8 +17,9 @@ import (
 )
 
 func (server *Server) Subscribe(ctx context.Context, req *aviator.SubscribeRequest) (*aviator.SubscribeResponse, error) {
-	currentSettings := &aviator.PlaneSettings{}
-	if err := server.db.FindOne(CLIENTS_COLLECTION, bson.M{"orgId": req.OrgID}, currentSettings); err != nil {
+	currentSettings, err := server.settingsStore.GetSettings(ctx, req.OrgID)
+	if err != nil {
+		currentSettings = &aviator.PlaneSettings{}
 		currentSettings.MaxDemoStake = 1
 		currentSettings.OrgID = req.OrgID
 		currentSettings.MinTotalBets = 100
@@ -27,117 +30,202 @@ func (server *Server) Subscribe(ctx context.Context, req *aviator.SubscribeReque
 		currentSettings.MinRiskPercentage = 0.5
 		currentSettings.MaxMultiplierShift = 1.4
 		currentSettings.LisenseExpiration = utils.CalculateLisenseExpiration(time.Now(), req.Package, req.Duration)
-		if _, err := server.db.InsertOne(CLIENTS_COLLECTION, currentSettings); err != nil {
+		if err := server.settingsStore.CreateSettings(ctx, currentSettings); err != nil {
 			return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to insert plane settings").WithInternal(err)
 		}
 	} else {
 		currentExp := time.Unix(currentSettings.LisenseExpiration, 0)
 		currentSettings.LisenseExpiration = utils.CalculateLisenseExpiration(currentExp, req.Package, req.Duration)
-		if err := server.db.UpdateOne(CLIENTS_COLLECTION, bson.M{"orgId": req.OrgID}, bson.M{"$set": bson.M{"lisenseExpiration": currentSettings.LisenseExpiration}}); err != nil {
+		currentSettings.Version++
+		update := bson.M{"$set": bson.M{"licenseExpiry": currentSettings.LisenseExpiration, "version": currentSettings.Version}}
+		if err := server.settingsStore.UpdateSettings(ctx, bson.M{"orgId": req.OrgID}, update); err != nil {
 			return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to update plane settings").WithInternal(err)
 		}
+		server.recordSettingsChange(req.OrgID, currentSettings.Version, "platform", []*aviator.SettingsFieldChange{{
+			Field: "licenseExpiry",
+			From:  fmt.Sprint(currentExp.Unix()),
+			To:    fmt.Sprint(currentSettings.LisenseExpiration),
+		}})
 		server.initializePlane(req.OrgID)
 	}
 	return &aviator.SubscribeResponse{Settings: currentSettings, Message: "subscription has been updated"}, nil
 }
 
 func (server *Server) GetPlaneSettings(ctx context.Context, req *aviator.GetPlaneSettingsRequest) (*aviator.PlaneSettings, error) {
-	currentSettings := &aviator.PlaneSettings{}
-	if err := server.db.FindOne(CLIENTS_COLLECTION, bson.M{"orgId": req.OrgID}, currentSettings); err != nil {
+	currentSettings, err := server.settingsStore.GetSettings(ctx, req.OrgID)
+	if err != nil {
 		return nil, utils.NewServiceError(http.StatusNotFound, "plane settings not found").WithInternal(err)
 	}
 	return currentSettings, nil
 }
 
 func (server *Server) UpdatePlaneSettings(ctx context.Context, req *aviator.PlaneSettings) (*aviator.UpdatePlaneSettingsResponse, error) {
-	if err := server.db.UpdateOne(CLIENTS_COLLECTION, bson.M{"orgId": req.OrgID}, bson.M{"$set": req}); err != nil {
-		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to update plane settings").WithInternal(err)
-	}
-	settings := &aviator.PlaneSettings{}
-	if err := server.db.FindOne(CLIENTS_COLLECTION, bson.M{"orgId": req.OrgID}, settings); err != nil {
-		return nil, utils.NewServiceError(http.StatusNotFound, "plane settings not found").WithInternal(err)
+	settings, err := server.updatePlaneSettings(ctx, req)
+	if err != nil {
+		return nil, err
 	}
 	return &aviator.UpdatePlaneSettingsResponse{Message: "settings updated", Settings: settings}, nil
 }
 
+func (server *Server) AdjustTreasury(ctx context.Context, req *aviator.AdjustTreasuryRequest) (*aviator.Treasury, error) {
+	return server.adjustTreasury(ctx, req)
+}
+
 func (server *Server) PlaneCashout(ctx context.Context, req *aviator.PlaneBet) (*aviator.PlaneCashoutResponse, error) {
-	flightRedisKey := planeflightRedisKey(req.OrgID, req.FlightID)
-	flightBetsRedisKey := flightBetsRedisKey(req.OrgID, req.FlightID)
-	path := fmt.Sprintf("$.[?(@.id=='%s' && @.flightId=='%s')]", req.BetId, req.FlightID)
-	if err := server.redis.Read(flightBetsRedisKey, path, &req); err != nil {
-		return nil, utils.NewServiceError(http.StatusNotFound, "bet does not exist").WithInternal(err)
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.UserID, req.OrgID = user.ID, user.OrgID
+	if err := server.checkRoundsOwner(req.OrgID); err != nil {
+		return nil, err
 	}
-
 	flight, err := server.getFlightById(req.OrgID, req.FlightID)
 	if err != nil {
 		return nil, utils.NewServiceError(http.StatusNotFound, "flight does not exist").WithInternal(err)
 	}
-	req.Status = "closed"
-	req.Payout = flight.Multiplier * req.Stake
-	server.auth.AddToAccountBalance(ctx, &auth.AddToAccountBalanceRequest{
-		OrgID:  req.OrgID,
-		Amount: req.Payout,
-		UserId: req.UserID,
-		Target: req.Account,
-		Source: server.config.ServiceName,
-	})
-	if req.Account == "live" {
-		server.redis.Client.JSONNumIncrBy(context.Background(), flightRedisKey, "$.profitBlown", req.Payout)
-	}
-	if err := server.redis.Client.JSONDel(context.Background(), flightBetsRedisKey, path).Err(); err != nil {
+	if req, err = server.takeBet(ctx, flight, req.BetId, req.UserID, false); err != nil {
+		if errors.Is(err, errBetNotFound) {
+			return nil, utils.NewServiceError(http.StatusNotFound, "bet does not exist").WithInternal(err)
+		}
+		if errors.Is(err, errFlightEnded) {
+			return nil, utils.NewServiceError(http.StatusConflict, "the plane has already exploded").WithInternal(err)
+		}
 		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to place bet").WithInternal(err)
 	}
+	settings := flight.Settings
+	if settings == nil {
+		settings = server.getPlaneSettings(req.OrgID)
+	}
+	currency := server.betCurrency(settings, req)
+	payout := payoutMinor(server.moneyMinor(req.StakeMoney, req.Stake), flight.Multiplier)
+	if req.FreeBetID != "" {
+		payout = freeBetWinnings(payout, server.moneyMinor(req.StakeMoney, req.Stake))
+	}
+	req.Payout, req.PayoutMoney = fromMinor(payout, currency), money(payout, currency)
+	req.CashedOutAt = server.clock.Now().UnixMilli()
+	if flight.TickedAt > 0 {
+		req.TickOffset = req.CashedOutAt - flight.TickedAt
+	}
+	if err := server.creditWallet(ctx, newWalletOp(req, payout, WALLET_REASON_CASHOUT)); err != nil {
+		server.restorePlaneBet(req)
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to credit cashout").WithInternal(err)
+	}
+	if req.Account == "live" {
+		if basePayout, err := server.toBase(settings, payout, currency); err != nil {
+			server.log.Err(err).Msgf("failed to value cashout %s", req.BetId)
+		} else if err := server.flightStore.AddProfitBlown(ctx, req.OrgID, req.FlightID, currency, money(basePayout, server.baseCurrency(settings)), payout); err != nil {
+			server.log.Err(err).Msgf("failed to record cashout %s against the flight", req.BetId)
+		}
+		if req.FreeBetID == "" {
+			server.observePayout(settings, currency, payout)
+		}
+	}
 	req.Status = "cashedout"
-	go server.db.InsertOne(BETS_COLLECTION, req)
-	server.messaging.Send(messaging.EventMessage{Event: "flightbet:update", Room: req.UserID, OrgId: req.OrgID, Message: req})
+	go server.historyStore.ArchiveBet(context.Background(), req)
+	server.sendEvent(ctx, messaging.EventMessage{Event: "flightbet:update", Room: req.UserID, OrgId: req.OrgID, Message: req})
 	return &aviator.PlaneCashoutResponse{Message: "bet cashed out"}, nil
 }
 
 func (server *Server) CancelPlaneBet(ctx context.Context, req *aviator.PlaneBet) (*aviator.CancelPlaneBetResponse, error) {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.UserID, req.OrgID = user.ID, user.OrgID
+	if err := server.checkRoundsOwner(req.OrgID); err != nil {
+		return nil, err
+	}
 	flight, err := server.getFlightById(req.OrgID, req.FlightID)
 	if err != nil {
 		return nil, utils.NewServiceError(http.StatusNotFound, "flight does not exist").WithInternal(err)
 	}
 
-	flightBetsRedisKey := flightBetsRedisKey(flight.OrgID, flight.ID)
-	path := fmt.Sprintf("$.[?(@.id=='%s' && @.flightId=='%s' && @.status!='closed')]", req.BetId, flight.ID)
-	if err := server.redis.Read(flightBetsRedisKey, path, req); err != nil {
-		return nil, utils.NewServiceError(http.StatusNotFound, "bet does not exist in this flight").WithInternal(err)
-	}
-
-	if err := server.redis.Client.JSONDel(context.Background(), flightBetsRedisKey, path).Err(); err != nil {
+	if req, err = server.takeBet(ctx, flight, req.BetId, req.UserID, true); err != nil {
+		if errors.Is(err, errBetNotFound) {
+			return nil, utils.NewServiceError(http.StatusNotFound, "bet does not exist in this flight").WithInternal(err)
+		}
+		if errors.Is(err, errFlightEnded) {
+			return nil, utils.NewServiceError(http.StatusConflict, "the plane has already exploded").WithInternal(err)
+		}
+		if errors.Is(err, errBetFlying) {
+			return nil, utils.NewServiceError(http.StatusConflict, "the plane has taken off, the bet can only be cashed out").WithInternal(err)
+		}
 		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to cancel bet").WithInternal(err)
 	}
 
+	if req.FreeBetID != "" {
+		server.releaseFreeBet(req)
+	} else if err := server.creditWallet(ctx, newWalletOp(req, server.moneyMinor(req.StakeMoney, req.Stake), WALLET_REASON_REFUND)); err != nil {
+		server.restorePlaneBet(req)
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to refund bet").WithInternal(err)
+	}
 	req.Status = "canceled"
-	server.auth.AddToAccountBalance(ctx, &auth.AddToAccountBalanceRequest{
-		Amount: req.Stake,
-		OrgID:  req.OrgID,
-		UserId: req.UserID,
-		Target: req.Account,
-		Source: server.config.ServiceName,
-	})
-	server.messaging.Send(messaging.EventMessage{Event: "flightbet:update", Room: req.UserID, OrgId: req.OrgID, Message: req})
+	server.sendEvent(ctx, messaging.EventMessage{Event: "flightbet:update", Room: req.UserID, OrgId: req.OrgID, Message: req})
 	return &aviator.CancelPlaneBetResponse{Message: "bet canceled"}, nil
 }
 
 func (server *Server) PlacePlaneBet(ctx context.Context, bet *aviator.PlaneBet) (*aviator.PlacePlaneBetResponse, error) {
-	if user, err := server.auth.FindUserById(ctx, &auth.FindUserByIdRequest{UserId: bet.UserID}); err == nil {
-		flight, err := server.getFlightByState(user.OrgID, STATE_PENDING)
+	caller, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := server.checkRoundsOwner(caller.OrgID); err != nil {
+		return nil, err
+	}
+	if bet.FreeBetID != "" {
+		freeBet, err := server.findFreeBet(caller.OrgID, caller.ID, bet.FreeBetID)
+		if err != nil {
+			return nil, err
+		}
+		bet.Account = "live"
+		bet.Currency, bet.StakeMoney = freeBet.Currency, money(freeBet.Stake, freeBet.Currency)
+	}
+	settings := server.getPlaneSettings(caller.OrgID)
+	bet.Currency = server.betCurrency(settings, bet)
+	stake := bet.StakeMoney.GetMinor()
+	if bet.StakeMoney == nil {
+		stake = toMinor(bet.Stake, bet.Currency)
+	}
+	if stake <= 0 {
+		return nil, utils.NewServiceError(http.StatusBadRequest, "stake must be greater than zero")
+	}
+	if err := server.validateBetCurrency(settings, bet.Currency, stake); err != nil {
+		return nil, err
+	}
+	bet.Stake, bet.StakeMoney = fromMinor(stake, bet.Currency), money(stake, bet.Currency)
+	authCtx, done := startAuthCall(ctx, "FindUserById")
+	user, err := server.auth.FindUserById(authCtx, &auth.FindUserByIdRequest{UserId: caller.ID})
+	done(err)
+	if err == nil {
+		flight, err := server.getFlightByState(ctx, user.OrgID, STATE_PENDING)
 		if err != nil {
-			if loadingFlight, err := server.getFlightByState(user.OrgID, STATE_LOADING); err != nil {
+			if loadingFlight, err := server.getFlightByState(ctx, user.OrgID, STATE_LOADING); err != nil {
 				return nil, utils.NewServiceError(http.StatusNotFound, "there are no flights ready for betting").WithInternal(err)
 			} else {
 				flight = loadingFlight
 			}
 		}
-		flightBetsRedisKey := flightBetsRedisKey(flight.OrgID, flight.ID)
-		path := fmt.Sprintf("$.[?(@.flightId=='%s' && @.userId=='%s' && @.side=='%s')]", flight.ID, user.ID, bet.Side)
-		if err := server.redis.Read(flightBetsRedisKey, path, &aviator.PlaneBet{}); err != nil {
+		if placed, _ := server.hasSideBet(ctx, flight, user.ID, bet.Side); !placed {
 			balance := server.getCurrentUserBalance(user)
-			if balance < bet.Stake {
+			if bet.FreeBetID == "" && balance < bet.Stake {
 				return nil, utils.NewServiceError(http.StatusForbidden, "insufficient account balance")
 			}
+			if bet.Account == "live" {
+				if err := server.checkPlayerRisk(ctx, user.OrgID, user.ID); err != nil {
+					return nil, err
+				}
+				limitStake, err := server.toBase(settings, stake, bet.Currency)
+				if err != nil {
+					return nil, utils.NewServiceError(http.StatusBadRequest, fmt.Sprintf("bets in %s are not accepted", bet.Currency)).WithInternal(err)
+				}
+				if bet.FreeBetID != "" {
+					limitStake = 0
+				}
+				if err := server.checkGamblingLimits(ctx, settings, user.ID, limitStake); err != nil {
+					return nil, err
+				}
+			}
 			bet.Status = "waiting"
 			if flight.State == STATE_LOADING {
 				bet.Status = "open"
@@ -145,19 +233,24 @@ func (server *Server) PlacePlaneBet(ctx context.Context, bet *aviator.PlaneBet)
 			bet.UserID = user.ID
 			bet.OrgID = user.OrgID
 			bet.FlightID = flight.ID
-			bet.DateCreated = time.Now().Unix()
+			bet.DateCreated = server.clock.Now().Unix()
 			bet.BetId = primitive.NewObjectID().Hex()
-			if _, err := server.redis.Client.JSONArrAppend(context.Background(), flightBetsRedisKey, "$", bet).Result(); err != nil {
+			if bet.FreeBetID != "" {
+				if err := server.claimFreeBet(bet); err != nil {
+					return nil, err
+				}
+			} else if err := server.debitWallet(ctx, newWalletOp(bet, -stake, WALLET_REASON_BET)); err != nil {
+				return nil, utils.NewServiceError(http.StatusPaymentRequired, "failed to debit account").WithInternal(err)
+			}
+			if err := server.addBet(ctx, bet); err != nil {
+				if bet.FreeBetID != "" {
+					server.releaseFreeBet(bet)
+				} else if err := server.creditWallet(ctx, newWalletOp(bet, stake, WALLET_REASON_REFUND)); err != nil {
+					server.log.Err(err).Msgf("failed to refund unplaced bet %s", bet.BetId)
+				}
 				return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to place bet").WithInternal(err)
 			}
-			server.auth.AddToAccountBalance(ctx, &auth.AddToAccountBalanceRequest{
-				UserId: bet.UserID,
-				Amount: -bet.Stake,
-				Target: bet.Account,
-				OrgID:  user.OrgID,
-				Source: server.config.ServiceName,
-			})
-			server.messaging.Send(messaging.EventMessage{Event: "flightbet:update", Room: bet.UserID, OrgId: bet.OrgID, Message: bet})
+			server.sendEvent(ctx, messaging.EventMessage{Event: "flightbet:update", Room: bet.UserID, OrgId: bet.OrgID, Message: bet})
 			return &aviator.PlacePlaneBetResponse{Message: "bet has been created", Bet: bet}, nil
 		}
 		return nil, utils.NewServiceError(http.StatusForbidden, fmt.Sprintf("you have already placed a %s side bet for this flight", bet.Side))
@@ -166,15 +259,19 @@ func (server *Server) PlacePlaneBet(ctx context.Context, bet *aviator.PlaneBet)
 }
 
 func (server *Server) GetPlaneBets(ctx context.Context, req *aviator.GetPlaneBetsRequest) (*aviator.GetPlaneBetsResponse, error) {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 	bets := []*aviator.PlaneBet{}
-	if err := server.db.GetPage(BETS_COLLECTION, bson.M{"userId": req.UserID}, req.Page, req.Limit, 1, &bets); err != nil {
+	if err := server.db.GetPage(BETS_COLLECTION, bson.M{"userId": user.ID}, req.Page, req.Limit, 1, &bets); err != nil {
 		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to get plane bets").WithInternal(err)
 	}
 	return &aviator.GetPlaneBetsResponse{Bets: bets}, nil
 }
 
 func (server *Server) GetPlaneHistory(ctx context.Context, req *aviator.GetPlaneHistoryRequest) (*aviator.GetPlaneHistoryResponse, error) {
-	if explosionHistory, err := server.redis.Client.LRange(ctx, fmt.Sprintf("%s-plane-history", req.OrgID), 0, -1).Result(); err != nil {
+	if explosionHistory, err := server.historyStore.GetResults(ctx, req.OrgID); err != nil {
 		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to get plane history").WithInternal(err)
 	} else {
 		return &aviator.GetPlaneHistoryResponse{History: explosionHistory}, nil
@@ -182,22 +279,416 @@ func (server *Server) GetPlaneHistory(ctx context.Context, req *aviator.GetPlane
 }
 
 func (server *Server) GetActiveBets(ctx context.Context, req *aviator.GetActiveBetsRequest) (*aviator.GetActiveBetsResponse, error) {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.UserID, req.OrgID = user.ID, user.OrgID
+	active, err := server.activeBets(ctx, req.OrgID, req.UserID)
+	if err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to get active bets").WithInternal(err)
+	}
 	bets := []*aviator.PlaneBet{}
-	if flightsBetStores, err := server.redis.Client.Keys(context.TODO(), fmt.Sprintf("%s-flight:bets-*", req.OrgID)).Result(); err == nil {
-		for _, betStore := range flightsBetStores {
-			betsInOneFlight := []*aviator.PlaneBet{}
-			path := fmt.Sprintf("$.[?(@.userId=='%s')]", req.UserID)
-			if err := server.redis.Read(betStore, path, &betsInOneFlight); err == nil {
-				for _, bet := range betsInOneFlight {
-					if flight, err := server.getFlightById(req.OrgID, bet.FlightID); err == nil {
-						if flight.State == STATE_FLYING {
-							bet.Status = "closed"
-						}
-						bets = append(bets, bet)
-					}
-				}
+	for _, bet := range active {
+		if flight, err := server.getFlightById(req.OrgID, bet.FlightID); err == nil {
+			if flight.State == STATE_FLYING {
+				bet.Status = "closed"
 			}
+			bets = append(bets, bet)
 		}
 	}
 	return &aviator.GetActiveBetsResponse{Bets: bets}, nil
 }
+
+func (server *Server) ListPendingWalletOps(ctx context.Context, req *aviator.ListPendingWalletOpsRequest) (*aviator.ListPendingWalletOpsResponse, error) {
+	ops := []*aviator.WalletOp{}
+	filter := bson.M{"status": WALLET_OP_PENDING}
+	if req.DeadLettered {
+		filter["status"] = WALLET_OP_DEAD
+	}
+	if req.OrgID != "" {
+		filter["orgId"] = req.OrgID
+	}
+	if err := server.db.GetPage(WALLET_OPS_COLLECTION, filter, req.Page, req.Limit, 1, &ops); err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to get wallet ops").WithInternal(err)
+	}
+	return &aviator.ListPendingWalletOpsResponse{Ops: ops}, nil
+}
+
+func (server *Server) GetReconciliations(ctx context.Context, req *aviator.GetReconciliationsRequest) (*aviator.GetReconciliationsResponse, error) {
+	reconciliations := []*aviator.Reconciliation{}
+	filter := bson.M{"orgId": req.OrgID}
+	if req.From != "" || req.To != "" {
+		days := bson.M{}
+		if req.From != "" {
+			days["$gte"] = req.From
+		}
+		if req.To != "" {
+			days["$lte"] = req.To
+		}
+		filter["day"] = days
+	}
+	if err := server.db.GetPage(RECONCILIATIONS_COLLECTION, filter, req.Page, req.Limit, -1, &reconciliations); err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to get reconciliations").WithInternal(err)
+	}
+	return &aviator.GetReconciliationsResponse{Reconciliations: reconciliations}, nil
+}
+
+func (server *Server) GetSettingsHistory(ctx context.Context, req *aviator.GetSettingsHistoryRequest) (*aviator.GetSettingsHistoryResponse, error) {
+	history := []*aviator.SettingsChange{}
+	if err := server.db.GetPage(SETTINGS_HISTORY_COLLECTION, bson.M{"orgId": req.OrgID}, req.Page, req.Limit, -1, &history); err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to get settings history").WithInternal(err)
+	}
+	return &aviator.GetSettingsHistoryResponse{History: history}, nil
+}
+
+func (server *Server) GetJackpot(ctx context.Context, req *aviator.GetJackpotRequest) (*aviator.Jackpot, error) {
+	jackpot := &aviator.Jackpot{}
+	if err := server.db.FindOne(JACKPOTS_COLLECTION, bson.M{"_id": req.OrgID}, jackpot); err != nil {
+		return nil, utils.NewServiceError(http.StatusNotFound, "jackpot not found").WithInternal(err)
+	}
+	return jackpot, nil
+}
+
+func (server *Server) WatchJackpot(req *aviator.GetJackpotRequest, stream aviator.Aviator_WatchJackpotServer) error {
+	ticker := time.NewTicker(JACKPOT_WATCH_EVERY)
+	defer ticker.Stop()
+	last := int64(-1)
+	for {
+		jackpot := &aviator.Jackpot{}
+		if err := server.db.FindOne(JACKPOTS_COLLECTION, bson.M{"_id": req.OrgID}, jackpot); err == nil && jackpot.Amount != last {
+			if err := stream.Send(jackpot); err != nil {
+				return err
+			}
+			last = jackpot.Amount
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (server *Server) IssueFreeBets(ctx context.Context, req *aviator.IssueFreeBetsRequest) (*aviator.IssueFreeBetsResponse, error) {
+	if req.CampaignID == "" || len(req.UserIDs) == 0 || req.Count <= 0 || req.Stake <= 0 {
+		return nil, utils.NewServiceError(http.StatusBadRequest, "a campaign, users, a count and a stake are required")
+	}
+	if int64(len(req.UserIDs))*req.Count > MAX_FREE_BETS {
+		return nil, utils.NewServiceError(http.StatusBadRequest, fmt.Sprintf("at most %d free bets can be issued at once", MAX_FREE_BETS))
+	}
+	currency := req.Currency
+	if currency == "" {
+		currency = server.baseCurrency(server.getPlaneSettings(req.OrgID))
+	}
+	freeBets := []*aviator.FreeBet{}
+	for _, userID := range req.UserIDs {
+		for i := int64(0); i < req.Count; i++ {
+			freeBets = append(freeBets, &aviator.FreeBet{
+				UserID:      userID,
+				Stake:       req.Stake,
+				Currency:    currency,
+				OrgID:       req.OrgID,
+				ExpiresAt:   req.ExpiresAt,
+				CampaignID:  req.CampaignID,
+				Status:      FREE_BET_AVAILABLE,
+				DateCreated: time.Now().Unix(),
+				ID:          primitive.NewObjectID().Hex(),
+			})
+		}
+	}
+	if err := server.db.InsertMany(FREE_BETS_COLLECTION, freeBets); err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to issue free bets").WithInternal(err)
+	}
+	return &aviator.IssueFreeBetsResponse{Message: "free bets issued", Issued: int64(len(freeBets))}, nil
+}
+
+func (server *Server) GetFreeBets(ctx context.Context, req *aviator.GetFreeBetsRequest) (*aviator.GetFreeBetsResponse, error) {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	freeBets := []*aviator.FreeBet{}
+	filter := bson.M{
+		"userId": user.ID,
+		"orgId":  user.OrgID,
+		"status": FREE_BET_AVAILABLE,
+		"$or":    bson.A{bson.M{"expiresAt": 0}, bson.M{"expiresAt": bson.M{"$gte": time.Now().Unix()}}},
+	}
+	if err := server.db.Find(FREE_BETS_COLLECTION, filter, &freeBets); err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to get free bets").WithInternal(err)
+	}
+	return &aviator.GetFreeBetsResponse{FreeBets: freeBets}, nil
+}
+
+func (server *Server) GetCashbackStatus(ctx context.Context, req *aviator.GetCashbackStatusRequest) (*aviator.GetCashbackStatusResponse, error) {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	settings := server.getPlaneSettings(user.OrgID)
+	start, end := cashbackPeriod(settings.Cashback, time.Now())
+	losses, err := server.netLosses(user.OrgID, user.ID, start, end)
+	if err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to get cashback status").WithInternal(err)
+	}
+	response := &aviator.GetCashbackStatusResponse{
+		PeriodEnd:   end.Unix(),
+		PeriodStart: start.Unix(),
+		Enabled:     settings.Cashback.GetEnabled(),
+		Percentage:  settings.Cashback.GetPercentage(),
+		Current:     []*aviator.CashbackProgress{},
+		History:     []*aviator.Cashback{},
+	}
+	for key, netLoss := range losses {
+		response.Current = append(response.Current, &aviator.CashbackProgress{
+			NetLoss:   netLoss,
+			Currency:  key.currency,
+			Estimated: cashbackAmount(settings.Cashback, netLoss),
+		})
+	}
+	filter := bson.M{"orgId": user.OrgID, "userId": user.ID}
+	if err := server.db.GetPage(CASHBACKS_COLLECTION, filter, "", CASHBACK_HISTORY_LIMIT, -1, &response.History); err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to get cashback history").WithInternal(err)
+	}
+	return response, nil
+}
+
+func (server *Server) GetCashbackReport(ctx context.Context, req *aviator.GetCashbackReportRequest) (*aviator.GetCashbackReportResponse, error) {
+	filter := bson.M{"orgId": req.OrgID}
+	if req.From > 0 || req.To > 0 {
+		period := bson.M{}
+		if req.From > 0 {
+			period["$gte"] = req.From
+		}
+		if req.To > 0 {
+			period["$lte"] = req.To
+		}
+		filter["periodStart"] = period
+	}
+	report := &aviator.GetCashbackReportResponse{Cashbacks: []*aviator.Cashback{}, TotalsByCurrency: map[string]int64{}}
+	if err := server.db.GetPage(CASHBACKS_COLLECTION, filter, req.Page, req.Limit, -1, &report.Cashbacks); err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to get cashback report").WithInternal(err)
+	}
+	all := []*aviator.Cashback{}
+	if err := server.db.Find(CASHBACKS_COLLECTION, filter, &all); err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to get cashback report").WithInternal(err)
+	}
+	for _, cashback := range all {
+		report.TotalsByCurrency[cashback.Currency] += cashback.Amount
+	}
+	return report, nil
+}
+
+func (server *Server) CreateTournament(ctx context.Context, req *aviator.Tournament) (*aviator.Tournament, error) {
+	if req.Currency == "" {
+		req.Currency = server.baseCurrency(server.getPlaneSettings(req.OrgID))
+	}
+	if err := validateTournament(req); err != nil {
+		return nil, err
+	}
+	req.Results = nil
+	req.Players = []string{}
+	req.Status = TOURNAMENT_OPEN
+	req.DateCreated = time.Now().Unix()
+	req.ID = primitive.NewObjectID().Hex()
+	if _, err := server.db.InsertOne(TOURNAMENTS_COLLECTION, req); err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to create tournament").WithInternal(err)
+	}
+	return req, nil
+}
+
+func (server *Server) RegisterForTournament(ctx context.Context, req *aviator.RegisterForTournamentRequest) (*aviator.RegisterForTournamentResponse, error) {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tournament := &aviator.Tournament{}
+	if err := server.db.FindOne(TOURNAMENTS_COLLECTION, bson.M{"_id": req.TournamentID, "orgId": user.OrgID}, tournament); err != nil {
+		return nil, utils.NewServiceError(http.StatusNotFound, "tournament not found").WithInternal(err)
+	}
+	if tournament.Status != TOURNAMENT_OPEN || time.Now().Unix() >= tournament.EndsAt {
+		return nil, utils.NewServiceError(http.StatusForbidden, "tournament has ended")
+	}
+	if slices.Contains(tournament.Players, user.ID) {
+		return &aviator.RegisterForTournamentResponse{Message: "already registered"}, nil
+	}
+	filter := bson.M{"_id": tournament.ID, "status": TOURNAMENT_OPEN}
+	if tournament.MaxPlayers > 0 {
+		// the seat past the last one must still be free when the player is added
+		filter[fmt.Sprintf("players.%d", tournament.MaxPlayers-1)] = bson.M{"$exists": false}
+	}
+	if err := server.db.UpdateOne(TOURNAMENTS_COLLECTION, filter, bson.M{"$addToSet": bson.M{"players": user.ID}}); err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to register for tournament").WithInternal(err)
+	}
+	registered := &aviator.Tournament{}
+	if err := server.db.FindOne(TOURNAMENTS_COLLECTION, bson.M{"_id": tournament.ID}, registered); err != nil || !slices.Contains(registered.Players, user.ID) {
+		return nil, utils.NewServiceError(http.StatusConflict, "tournament is full")
+	}
+	return &aviator.RegisterForTournamentResponse{Message: "registered"}, nil
+}
+
+func (server *Server) GetTournaments(ctx context.Context, req *aviator.GetTournamentsRequest) (*aviator.GetTournamentsResponse, error) {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{"orgId": user.OrgID}
+	if req.Status != "" {
+		filter["status"] = req.Status
+	}
+	tournaments := []*aviator.Tournament{}
+	if err := server.db.GetPage(TOURNAMENTS_COLLECTION, filter, req.Page, req.Limit, -1, &tournaments); err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to get tournaments").WithInternal(err)
+	}
+	for _, tournament := range tournaments {
+		tournament.Results, tournament.Players = nil, nil
+	}
+	return &aviator.GetTournamentsResponse{Tournaments: tournaments}, nil
+}
+
+func (server *Server) GetTournamentLeaderboard(ctx context.Context, req *aviator.GetTournamentLeaderboardRequest) (*aviator.GetTournamentLeaderboardResponse, error) {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tournament := &aviator.Tournament{}
+	if err := server.db.FindOne(TOURNAMENTS_COLLECTION, bson.M{"_id": req.TournamentID, "orgId": user.OrgID}, tournament); err != nil {
+		return nil, utils.NewServiceError(http.StatusNotFound, "tournament not found").WithInternal(err)
+	}
+	standings := tournament.Results
+	if tournament.Status != TOURNAMENT_FINISHED {
+		if standings, err = server.tournamentStandings(tournament); err != nil {
+			return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to get tournament leaderboard").WithInternal(err)
+		}
+	}
+	limit := int(req.Limit)
+	if limit <= 0 || limit > TOURNAMENT_STANDINGS_LIMIT {
+		limit = TOURNAMENT_STANDINGS_LIMIT
+	}
+	tournament.Results, tournament.Players = nil, nil
+	return &aviator.GetTournamentLeaderboardResponse{Tournament: tournament, Standings: standings[:min(limit, len(standings))]}, nil
+}
+
+func (server *Server) SendChatMessage(ctx context.Context, req *aviator.SendChatMessageRequest) (*aviator.ChatMessage, error) {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	message := &aviator.ChatMessage{
+		UserID:      user.ID,
+		OrgID:       user.OrgID,
+		DateCreated: time.Now().Unix(),
+		ID:          primitive.NewObjectID().Hex(),
+	}
+	if req.BetID != "" {
+		if message.BetCard, err = server.betCard(user.OrgID, user.ID, req.BetID); err != nil {
+			return nil, err
+		}
+	}
+	if req.Text != "" || message.BetCard == nil {
+		if message.Text, err = filterChatText(req.Text); err != nil {
+			return nil, err
+		}
+	}
+	if err := server.checkChatAccess(ctx, user.OrgID, user.ID); err != nil {
+		return nil, err
+	}
+	if err := server.publishChatMessage(ctx, message); err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to send message").WithInternal(err)
+	}
+	return message, nil
+}
+
+func (server *Server) GetChatHistory(ctx context.Context, req *aviator.GetChatHistoryRequest) (*aviator.GetChatHistoryResponse, error) {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := server.chatHistory(ctx, user.OrgID, req.Limit)
+	if err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to get chat history").WithInternal(err)
+	}
+	return &aviator.GetChatHistoryResponse{Messages: messages}, nil
+}
+
+func (server *Server) ModerateChat(ctx context.Context, req *aviator.ModerateChatRequest) (*aviator.ModerateChatResponse, error) {
+	if req.UserID == "" || !slices.Contains(chatActions, req.Action) {
+		return nil, utils.NewServiceError(http.StatusBadRequest, fmt.Sprintf("a user and one of %v are required", chatActions))
+	}
+	if err := server.moderateChat(ctx, req); err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to moderate chat").WithInternal(err)
+	}
+	return &aviator.ModerateChatResponse{Message: fmt.Sprintf("user %s: %s", req.UserID, req.Action)}, nil
+}
+
+func (server *Server) GetGamblingLimits(ctx context.Context, req *aviator.GetGamblingLimitsRequest) (*aviator.GamblingLimits, error) {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return server.getGamblingLimits(user.OrgID, user.ID), nil
+}
+
+func (server *Server) SetGamblingLimits(ctx context.Context, req *aviator.GamblingLimits) (*aviator.GamblingLimits, error) {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.OrgID, req.UserID = user.OrgID, user.ID
+	if err := validateGamblingLimits(req); err != nil {
+		return nil, err
+	}
+	if err := checkSelfImposedLimits(server.getGamblingLimits(user.OrgID, user.ID), req); err != nil {
+		return nil, err
+	}
+	limits, err := server.saveGamblingLimits(req, user.ID)
+	if err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to save gambling limits").WithInternal(err)
+	}
+	return limits, nil
+}
+
+func (server *Server) SetPlayerGamblingLimits(ctx context.Context, req *aviator.GamblingLimits) (*aviator.GamblingLimits, error) {
+	caller, err := adminFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.UserID == "" {
+		return nil, utils.NewServiceError(http.StatusBadRequest, "a user is required")
+	}
+	if err := validateGamblingLimits(req); err != nil {
+		return nil, err
+	}
+	limits, err := server.saveGamblingLimits(req, caller.Name())
+	if err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to save gambling limits").WithInternal(err)
+	}
+	return limits, nil
+}
+
+func (server *Server) GetSuspiciousPlayers(ctx context.Context, req *aviator.GetSuspiciousPlayersRequest) (*aviator.GetSuspiciousPlayersResponse, error) {
+	org := &aviator.OrgRisk{ID: req.OrgID, OrgID: req.OrgID}
+	if err := server.db.FindOne(ORG_RISK_COLLECTION, bson.M{"_id": req.OrgID}, org); err != nil {
+		server.log.Err(err).Msgf("no risk scan yet for org %s", req.OrgID)
+	}
+	players := []*aviator.PlayerRisk{}
+	filter := bson.M{"orgId": req.OrgID, "score": bson.M{"$gt": max(req.MinScore, 0)}}
+	if err := server.db.GetPage(PLAYER_RISK_COLLECTION, filter, req.Page, req.Limit, -1, &players); err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to get suspicious players").WithInternal(err)
+	}
+	return &aviator.GetSuspiciousPlayersResponse{Org: org, Players: players}, nil
+}
+
+func (server *Server) GetPlaneStatus(ctx context.Context, req *aviator.GetPlaneStatusRequest) (*aviator.GetPlaneStatusResponse, error) {
+	return &aviator.GetPlaneStatusResponse{Planes: server.planeStatuses(req.OrgID)}, nil
+}
+
+// GetFlightState returns the whole state of the org's flight with the seq of the
+// last message sent about it, for clients that join or missed a delta.
+func (server *Server) GetFlightState(ctx context.Context, req *aviator.GetFlightStateRequest) (*aviator.FlightState, error) {
+	if state, ok := server.flightState(req.OrgID); ok {
+		return state, nil
+	}
+	return nil, utils.NewServiceError(http.StatusNotFound, "flight state not found")
+}
@@ -0,0 +1,401 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thedivinez/go-libs/messaging"
+	"github.com/thedivinez/go-libs/services/auth"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"github.com/thedivinez/grandaviator/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+const testOrg = "org-e2e"
+
+// fakeAuth is the auth service: every user's token is their id and wallet
+// movements are applied to balances in memory.
+type fakeAuth struct {
+	auth.AuthenticationClient
+	sync.Mutex
+	clock   *manualClock
+	users   map[string]*auth.User
+	applied map[string]bool
+	ledger  []*auth.LedgerEntry
+	// timeout makes the next movement apply but answer as if it timed out
+	timeout bool
+}
+
+func (fake *fakeAuth) user(userID string) (*auth.User, error) {
+	fake.Lock()
+	defer fake.Unlock()
+	user, ok := fake.users[userID]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (fake *fakeAuth) VerifySession(ctx context.Context, req *auth.VerifySessionRequest, opts ...grpc.CallOption) (*auth.VerifySessionResponse, error) {
+	user, err := fake.user(req.Token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid session")
+	}
+	return &auth.VerifySessionResponse{User: user}, nil
+}
+
+func (fake *fakeAuth) FindUserById(ctx context.Context, req *auth.FindUserByIdRequest, opts ...grpc.CallOption) (*auth.User, error) {
+	return fake.user(req.UserId)
+}
+
+func (fake *fakeAuth) AddToAccountBalance(ctx context.Context, req *auth.AddToAccountBalanceRequest, opts ...grpc.CallOption) (*auth.AddToAccountBalanceResponse, error) {
+	fake.Lock()
+	defer fake.Unlock()
+	user, ok := fake.users[req.UserId]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	if !fake.applied[req.IdempotencyKey] {
+		fake.applied[req.IdempotencyKey] = true
+		fake.ledger = append(fake.ledger, &auth.LedgerEntry{
+			OrgID:          req.OrgID,
+			UserId:         req.UserId,
+			Amount:         req.Amount,
+			Target:         req.Target,
+			Source:         req.Source,
+			IdempotencyKey: req.IdempotencyKey,
+			DateCreated:    fake.clock.Now().Unix(),
+		})
+		if req.Target == "live" {
+			user.LiveBalance += req.Amount
+		} else {
+			user.DemoBalance += req.Amount
+		}
+	}
+	if fake.timeout {
+		fake.timeout = false
+		return nil, status.Error(codes.DeadlineExceeded, "timed out")
+	}
+	return &auth.AddToAccountBalanceResponse{}, nil
+}
+
+func (fake *fakeAuth) ListLedgerEntries(ctx context.Context, req *auth.ListLedgerEntriesRequest, opts ...grpc.CallOption) (*auth.ListLedgerEntriesResponse, error) {
+	fake.Lock()
+	defer fake.Unlock()
+	entries := []*auth.LedgerEntry{}
+	for _, entry := range fake.ledger {
+		if entry.OrgID == req.OrgID && entry.Source == req.Source && entry.Target == req.Target && entry.DateCreated >= req.From && entry.DateCreated < req.To {
+			entries = append(entries, entry)
+		}
+	}
+	return &auth.ListLedgerEntriesResponse{Entries: entries}, nil
+}
+
+func (fake *fakeAuth) balance(t *testing.T, userID string) float64 {
+	user, err := fake.user(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.LiveBalance
+}
+
+// fakeMessenger keeps every event sent to the socket service.
+type fakeMessenger struct {
+	sync.Mutex
+	events []messaging.EventMessage
+}
+
+func (fake *fakeMessenger) Send(event messaging.EventMessage) error {
+	fake.Lock()
+	defer fake.Unlock()
+	fake.events = append(fake.events, event)
+	return nil
+}
+
+// flightStates replays the flight broadcasts the way a client sees them: every
+// flight:state replaces what it knows and every flight:delta moves it along.
+// It returns what the client knew after each message and fails on a gap.
+func (fake *fakeMessenger) flightStates(t *testing.T) []*aviator.FlightState {
+	t.Helper()
+	fake.Lock()
+	defer fake.Unlock()
+	states, known := []*aviator.FlightState{}, (*aviator.FlightState)(nil)
+	for _, event := range fake.events {
+		switch message := event.Message.(type) {
+		case *aviator.FlightState:
+			known = proto.Clone(message).(*aviator.FlightState)
+		case *aviator.FlightStateDelta:
+			if known == nil || message.ID != known.ID || message.Seq != known.Seq+1 {
+				t.Fatalf("delta %d of flight %s does not follow %v", message.Seq, message.ID, known)
+			}
+			known = proto.Clone(known).(*aviator.FlightState)
+			known.Seq, known.Multiplier = message.Seq, message.Multiplier
+			for _, cashout := range message.CashedOut {
+				for idx, entry := range known.LeaderBoard {
+					if entry.Name == cashout.Name {
+						known.LeaderBoard[idx] = cashout
+					}
+				}
+			}
+		default:
+			continue
+		}
+		states = append(states, known)
+	}
+	return states
+}
+
+func (fake *fakeMessenger) count(event string) int {
+	fake.Lock()
+	defer fake.Unlock()
+	count := 0
+	for _, sent := range fake.events {
+		if sent.Event == event {
+			count++
+		}
+	}
+	return count
+}
+
+// manualClock only moves when the test advances it. Ticks are dropped when the
+// reader is behind, like a time.Ticker.
+type manualClock struct {
+	sync.Mutex
+	now     time.Time
+	tickers []*manualTicker
+}
+
+type manualTicker struct {
+	clock    *manualClock
+	interval time.Duration
+	next     time.Time
+	ticks    chan time.Time
+	stopped  bool
+}
+
+func newManualClock() *manualClock {
+	return &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (clock *manualClock) Now() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	return clock.now
+}
+
+func (clock *manualClock) NewTicker(interval time.Duration) Ticker {
+	clock.Lock()
+	defer clock.Unlock()
+	ticker := &manualTicker{clock: clock, interval: interval, next: clock.now.Add(interval), ticks: make(chan time.Time, 1)}
+	clock.tickers = append(clock.tickers, ticker)
+	return ticker
+}
+
+func (clock *manualClock) Advance(duration time.Duration) {
+	clock.Lock()
+	defer clock.Unlock()
+	clock.now = clock.now.Add(duration)
+	for _, ticker := range clock.tickers {
+		for ; !ticker.stopped && !ticker.next.After(clock.now); ticker.next = ticker.next.Add(ticker.interval) {
+			select {
+			case ticker.ticks <- clock.now:
+			default:
+			}
+		}
+	}
+	clock.tickers = slices.DeleteFunc(clock.tickers, func(ticker *manualTicker) bool { return ticker.stopped })
+}
+
+func (ticker *manualTicker) C() <-chan time.Time { return ticker.ticks }
+
+func (ticker *manualTicker) Stop() {
+	ticker.clock.Lock()
+	defer ticker.clock.Unlock()
+	ticker.stopped = true
+}
+
+// fixedRandom always draws the lowest float, so risk and multipliers are
+// predictable, and draws ints from a seeded source.
+type fixedRandom struct {
+	sync.Mutex
+	source *rand.Rand
+}
+
+func (random *fixedRandom) Float(min, max float64) float64 { return min }
+
+func (random *fixedRandom) Int(min, max int) int {
+	random.Lock()
+	defer random.Unlock()
+	if max <= min {
+		return min
+	}
+	return min + random.source.IntN(max-min)
+}
+
+type harness struct {
+	t         *testing.T
+	server    *Server
+	clock     *manualClock
+	auth      *fakeAuth
+	messenger *fakeMessenger
+	client    aviator.AviatorClient
+	listener  *bufconn.Listener
+}
+
+func testSettings() *aviator.PlaneSettings {
+	return &aviator.PlaneSettings{
+		OrgID:              testOrg,
+		MaxDemoStake:       1,
+		MinTotalBets:       100,
+		MaxTotalBets:       200,
+		MinDemoRiskAmount:  10,
+		MaxDemoRiskAmount:  10,
+		MinRiskPercentage:  0.2,
+		MaxRiskPercentage:  0.2,
+		MaxMultiplierShift: 0.5,
+		AutoExplodeAfter:   1000,
+		Treasuries:         map[string]*aviator.Treasury{"USD": {AmountToRisk: 1_000_000}},
+	}
+}
+
+// newHarness builds the service on memory stores with the given players, each
+// holding 100 live, without starting its loops or serving it.
+func newHarness(t *testing.T, players ...string) *harness {
+	t.Helper()
+	clock := newManualClock()
+	h := &harness{
+		t:         t,
+		clock:     clock,
+		messenger: &fakeMessenger{},
+		auth:      &fakeAuth{clock: clock, users: map[string]*auth.User{}, applied: map[string]bool{}},
+	}
+	for _, player := range players {
+		h.auth.users[player] = &auth.User{ID: player, OrgID: testOrg, CurrentAccount: "live", LiveBalance: 100}
+	}
+	h.server = newServer(&types.AuthServiceConfig{Storage: STORAGE_MEMORY, Currency: "USD", ServiceName: "aviator", AdvertiseAddress: "aviator-1"})
+	if err := h.server.openStorage(); err != nil {
+		t.Fatal(err)
+	}
+	h.server.auth, h.server.messaging = h.auth, h.messenger
+	h.server.clock, h.server.random = h.clock, &fixedRandom{source: rand.New(rand.NewPCG(1, 2))}
+	if err := h.server.settingsStore.CreateSettings(context.Background(), testSettings()); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// startHarness runs the service of newHarness over bufconn with its loops.
+func startHarness(t *testing.T, players ...string) *harness {
+	t.Helper()
+	h := newHarness(t, players...)
+	if err := h.server.startLoops(); err != nil {
+		t.Fatal(err)
+	}
+	h.listener = bufconn.Listen(1 << 20)
+	go h.server.Serve(h.listener)
+	h.client = aviator.NewAviatorClient(dialListener(t, h.listener))
+	return h
+}
+
+func dialListener(t *testing.T, listener *bufconn.Listener) *grpc.ClientConn {
+	t.Helper()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close(); listener.Close() })
+	return conn
+}
+
+// peer serves a second instance on the stores of the harness, it runs no
+// rounds and reaches the harness' instance over bufconn.
+func (h *harness) peer() aviator.AviatorClient {
+	h.t.Helper()
+	peer := newServer(&types.AuthServiceConfig{Storage: STORAGE_MEMORY, Currency: "USD", ServiceName: "aviator", AdvertiseAddress: "aviator-2"})
+	peer.db, peer.flightStore, peer.betStore = h.server.db, h.server.flightStore, h.server.betStore
+	peer.settingsStore, peer.historyStore = h.server.settingsStore, h.server.historyStore
+	peer.chatStore, peer.limitStore = h.server.chatStore, h.server.limitStore
+	peer.auth, peer.messaging, peer.clock, peer.random = h.auth, h.messenger, h.clock, h.server.random
+	peer.dialPeer = func(address string) (*grpc.ClientConn, error) {
+		if address != h.server.config.AdvertiseAddress {
+			return nil, fmt.Errorf("no instance at %s", address)
+		}
+		return dialListener(h.t, h.listener), nil
+	}
+	listener := bufconn.Listen(1 << 20)
+	go peer.Serve(listener)
+	return aviator.NewAviatorClient(dialListener(h.t, listener))
+}
+
+// asPlatform is the context of a request signed by the platform.
+func asPlatform() context.Context {
+	return context.WithValue(context.Background(), adminContextKey{}, &adminCaller{Platform: true})
+}
+
+func (h *harness) as(player string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+player)
+}
+
+// advanceUntil moves the clock one flight tick at a time until what the
+// clients know about the flight matches.
+func (h *harness) advanceUntil(what string, match func(*aviator.FlightState) bool) *aviator.FlightState {
+	h.t.Helper()
+	for range 5000 {
+		if states := h.messenger.flightStates(h.t); len(states) > 0 && match(states[len(states)-1]) {
+			return states[len(states)-1]
+		}
+		h.clock.Advance(FLIGHT_TICK_INTERVAL)
+		time.Sleep(time.Millisecond)
+	}
+	h.t.Fatalf("timed out waiting for %s", what)
+	return nil
+}
+
+// eventually waits for work the service finishes in the background.
+func (h *harness) eventually(what string, done func() bool) {
+	h.t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if done() {
+			return
+		}
+	}
+	h.t.Fatalf("timed out waiting for %s", what)
+}
+
+func (h *harness) placeBet(player, side string, stake float64) *aviator.PlaneBet {
+	h.t.Helper()
+	placed, err := h.client.PlacePlaneBet(h.as(player), &aviator.PlaneBet{Side: side, Stake: stake, Account: "live"})
+	if err != nil {
+		h.t.Fatalf("%s failed to place a bet: %v", player, err)
+	}
+	return placed.Bet
+}
+
+func (h *harness) treasury() *aviator.Treasury {
+	h.t.Helper()
+	settings, err := h.server.settingsStore.GetSettings(context.Background(), testOrg)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return settings.Treasuries["USD"]
+}
+
+func inState(state string) func(*aviator.FlightState) bool {
+	return func(flight *aviator.FlightState) bool { return flight.State == state }
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thedivinez/go-libs/services/auth"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// planeStatus is what the flight loop of an org last reported about itself.
+type planeStatus struct {
+	running     bool
+	state       string
+	flightID    string
+	lastError   string
+	startedAt   time.Time
+	lastTick    time.Time
+	lastErrorAt time.Time
+	// settings are the ones the current round runs under
+	settings *aviator.PlaneSettings
+}
+
+type planeRegistry struct {
+	sync.Mutex
+	orgs map[string]*planeStatus
+}
+
+func (server *Server) updatePlane(orgID string, update func(plane *planeStatus)) {
+	server.planes.Lock()
+	defer server.planes.Unlock()
+	if server.planes.orgs == nil {
+		server.planes.orgs = map[string]*planeStatus{}
+	}
+	plane, ok := server.planes.orgs[orgID]
+	if !ok {
+		plane = &planeStatus{}
+		server.planes.orgs[orgID] = plane
+	}
+	update(plane)
+}
+
+func (server *Server) planeStarted(orgID string) {
+	server.updatePlane(orgID, func(plane *planeStatus) {
+		plane.running, plane.startedAt, plane.lastTick = true, time.Now(), time.Now()
+	})
+}
+
+func (server *Server) planeStopped(orgID, reason string) {
+	server.updatePlane(orgID, func(plane *planeStatus) {
+		plane.running, plane.lastError, plane.lastErrorAt = false, reason, time.Now()
+	})
+}
+
+func (server *Server) planeTicked(flight *aviator.Flight) {
+	server.updatePlane(flight.OrgID, func(plane *planeStatus) {
+		plane.state, plane.flightID, plane.lastTick = flight.State, flight.ID, time.Now()
+		if flight.Settings != nil {
+			plane.settings = flight.Settings
+		}
+	})
+}
+
+// roundSettings returns the settings the current round of the org runs under,
+// they are read from the store only until a round has ticked here.
+func (server *Server) roundSettings(orgID string) *aviator.PlaneSettings {
+	server.planes.Lock()
+	plane, ok := server.planes.orgs[orgID]
+	var settings *aviator.PlaneSettings
+	if ok {
+		settings = plane.settings
+	}
+	server.planes.Unlock()
+	if settings == nil {
+		return server.getPlaneSettings(orgID)
+	}
+	return settings
+}
+
+// planeFailed logs an error of the flight loop and keeps it as the last error
+// of the org.
+func (server *Server) planeFailed(orgID string, err error, msg string) {
+	server.log.Err(err).Msg(msg)
+	server.updatePlane(orgID, func(plane *planeStatus) {
+		plane.lastError, plane.lastErrorAt = msg, time.Now()
+		if err != nil {
+			plane.lastError = msg + ": " + err.Error()
+		}
+	})
+}
+
+// planeStatuses reports the loops of every org, or of one org when orgID is set.
+// A loop that has not ticked within PLANE_STALL_AFTER is reported as stalled.
+func (server *Server) planeStatuses(orgID string) []*aviator.PlaneStatus {
+	server.planes.Lock()
+	defer server.planes.Unlock()
+	statuses := []*aviator.PlaneStatus{}
+	for id, plane := range server.planes.orgs {
+		if orgID != "" && id != orgID {
+			continue
+		}
+		response := &aviator.PlaneStatus{
+			OrgID:     id,
+			Running:   plane.running,
+			Stalled:   plane.running && time.Since(plane.lastTick) > PLANE_STALL_AFTER,
+			State:     plane.state,
+			FlightID:  plane.flightID,
+			LastTick:  plane.lastTick.UnixMilli(),
+			LastError: plane.lastError,
+			StartedAt: plane.startedAt.Unix(),
+		}
+		if !plane.lastErrorAt.IsZero() {
+			response.LastErrorAt = plane.lastErrorAt.Unix()
+		}
+		statuses = append(statuses, response)
+	}
+	if orgID != "" && len(statuses) == 0 {
+		statuses = append(statuses, &aviator.PlaneStatus{OrgID: orgID})
+	}
+	slices.SortFunc(statuses, func(a, b *aviator.PlaneStatus) int {
+		return strings.Compare(a.OrgID, b.OrgID)
+	})
+	return statuses
+}
+
+// probe runs a dependency check that may not honour the context, so a hung
+// dependency is reported as down instead of hanging the health loop.
+func probe(ctx context.Context, check func() error) error {
+	result := make(chan error, 1)
+	go func() { result <- check() }()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+}
+
+func (server *Server) checkDependencies(ctx context.Context) map[string]error {
+	return map[string]error{
+		"mongo": probe(ctx, func() error {
+			err := server.db.FindOne(CLIENTS_COLLECTION, bson.M{"_id": HEALTH_PROBE_ID}, &bson.M{})
+			if err == nil || errors.Is(err, mongo.ErrNoDocuments) {
+				return nil
+			}
+			return err
+		}),
+		"redis": probe(ctx, func() error {
+			return server.limitStore.Ping(ctx)
+		}),
+		// any answer from the auth service, even a rejected session, means it is up
+		"auth": probe(ctx, func() error {
+			_, err := server.auth.VerifySession(ctx, &auth.VerifySessionRequest{})
+			if code := status.Code(err); code == codes.Unavailable || code == codes.DeadlineExceeded {
+				return err
+			}
+			return nil
+		}),
+	}
+}
+
+// checkHealth marks the service NOT_SERVING while a dependency is down, so the
+// orchestrator can replace the instance. A stalled flight loop only concerns
+// its org, it is reported through GetPlaneStatus and aviator_plane_stalled
+// without taking the other orgs of the instance down with it.
+func (server *Server) checkHealth() {
+	ctx, cancel := context.WithTimeout(context.Background(), HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+	serving := healthpb.HealthCheckResponse_SERVING
+	for name, err := range server.checkDependencies(ctx) {
+		if err != nil {
+			server.log.Err(err).Msgf("%s is down", name)
+			serving = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+	}
+	for _, plane := range server.planeStatuses("") {
+		stalled := 0.0
+		if plane.Stalled {
+			server.log.Log().Msgf("flight loop of org %s has not ticked since %s", plane.OrgID, time.UnixMilli(plane.LastTick))
+			stalled = 1
+		}
+		planeStalled.WithLabelValues(plane.OrgID).Set(stalled)
+	}
+	server.health.SetServingStatus("", serving)
+	server.health.SetServingStatus(aviator.Aviator_ServiceDesc.ServiceName, serving)
+}
+
+func (server *Server) watchHealth() {
+	for range time.NewTicker(HEALTH_CHECK_EVERY).C {
+		server.checkHealth()
+	}
+}
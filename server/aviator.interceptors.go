@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/thedivinez/go-libs/services/auth"
+	"github.com/thedivinez/go-libs/utils"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+type userContextKey struct{}
+
+// playerMethods are the rpcs that act on behalf of a player and therefore need a
+// session token. Identity for these is taken from the context only.
+var playerMethods = []string{
+	"/Aviator/PlaneCashout",
+	"/Aviator/PlacePlaneBet",
+	"/Aviator/CancelPlaneBet",
+	"/Aviator/GetPlaneBets",
+	"/Aviator/GetActiveBets",
+	"/Aviator/GetFreeBets",
+	"/Aviator/GetCashbackStatus",
+	"/Aviator/RegisterForTournament",
+	"/Aviator/GetTournaments",
+	"/Aviator/GetTournamentLeaderboard",
+	"/Aviator/SendChatMessage",
+	"/Aviator/GetChatHistory",
+	"/Aviator/GetGamblingLimits",
+	"/Aviator/SetGamblingLimits",
+}
+
+// publicMethods are the rpcs anyone may call. An rpc that is in none of
+// publicMethods, playerMethods and adminMethods is refused.
+var publicMethods = []string{
+	"/Aviator/GetPlaneHistory",
+	"/Aviator/GetJackpot",
+	"/Aviator/WatchJackpot",
+	"/Aviator/GetFlightState",
+	"/Aviator/GetPlaneSettings",
+	healthpb.Health_Check_FullMethodName,
+	healthpb.Health_Watch_FullMethodName,
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+	// authorize is set when the stream is authorized on its first message
+	authorize func(ctx context.Context, req any) (context.Context, error)
+}
+
+func (stream *authenticatedStream) Context() context.Context {
+	return stream.ctx
+}
+
+func (stream *authenticatedStream) RecvMsg(m any) error {
+	if err := stream.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if authorize := stream.authorize; authorize != nil {
+		stream.authorize = nil
+		ctx, err := authorize(stream.ctx, m)
+		if err != nil {
+			return err
+		}
+		stream.ctx = ctx
+	}
+	return nil
+}
+
+func metadataValue(ctx context.Context, key string) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+func sessionToken(ctx context.Context) string {
+	if token := metadataValue(ctx, "authorization"); token != "" {
+		return strings.TrimSpace(strings.TrimPrefix(token, "Bearer "))
+	}
+	return strings.TrimSpace(metadataValue(ctx, "token"))
+}
+
+func userFromContext(ctx context.Context) (*auth.User, error) {
+	if user, ok := ctx.Value(userContextKey{}).(*auth.User); ok && user != nil {
+		return user, nil
+	}
+	return nil, utils.NewServiceError(http.StatusUnauthorized, "request is not authenticated")
+}
+
+func (server *Server) verifySession(ctx context.Context) (*auth.User, error) {
+	token := sessionToken(ctx)
+	if token == "" {
+		return nil, utils.NewServiceError(http.StatusUnauthorized, "missing session token")
+	}
+	authCtx, done := startAuthCall(ctx, "VerifySession")
+	session, err := server.auth.VerifySession(authCtx, &auth.VerifySessionRequest{Token: token})
+	done(err)
+	if err != nil || session.User == nil {
+		return nil, utils.NewServiceError(http.StatusUnauthorized, "invalid session token").WithInternal(err)
+	}
+	return session.User, nil
+}
+
+func (server *Server) authenticate(ctx context.Context, method string, req any) (context.Context, error) {
+	if platformOnly, ok := adminMethods[method]; ok {
+		return server.authorizeAdmin(ctx, method, req, platformOnly)
+	}
+	if slices.Contains(publicMethods, method) {
+		return ctx, nil
+	}
+	if !slices.Contains(playerMethods, method) {
+		return nil, utils.NewServiceError(http.StatusForbidden, fmt.Sprintf("%s is not open to callers", method))
+	}
+	user, err := server.verifySession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return context.WithValue(ctx, userContextKey{}, user), nil
+}
+
+func (server *Server) authenticateUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := server.authenticate(ctx, info.FullMethod, req)
+	if err != nil {
+		return nil, err
+	}
+	// the owner of the rounds limits the calls it is forwarded itself
+	if reply, forwarded, err := server.forwardToRounds(ctx, info.FullMethod, req); forwarded {
+		return reply, err
+	}
+	if err := server.rateLimit(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (server *Server) authenticateStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	// admin rpcs are scoped by their request, a server stream is authorized once
+	// the handler has received it
+	if _, admin := adminMethods[info.FullMethod]; admin && !info.IsClientStream {
+		authorize := func(ctx context.Context, req any) (context.Context, error) {
+			return server.authenticate(ctx, info.FullMethod, req)
+		}
+		return handler(srv, &authenticatedStream{ServerStream: stream, ctx: stream.Context(), authorize: authorize})
+	}
+	ctx, err := server.authenticate(stream.Context(), info.FullMethod, nil)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/thedivinez/go-libs/services/aviator"
+	"github.com/thedivinez/grandaviator/types"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestEveryRpcHasAnAccessRule(t *testing.T) {
+	methods := []string{}
+	for _, method := range aviator.Aviator_ServiceDesc.Methods {
+		methods = append(methods, method.MethodName)
+	}
+	for _, stream := range aviator.Aviator_ServiceDesc.Streams {
+		methods = append(methods, stream.StreamName)
+	}
+	for _, method := range methods {
+		name := "/" + aviator.Aviator_ServiceDesc.ServiceName + "/" + method
+		_, admin := adminMethods[name]
+		rules := 0
+		for _, listed := range []bool{admin, slices.Contains(playerMethods, name), slices.Contains(publicMethods, name)} {
+			if listed {
+				rules++
+			}
+		}
+		if rules != 1 {
+			t.Errorf("%s is in %d access lists, it should be in one", name, rules)
+		}
+	}
+	server := newServer(&types.AuthServiceConfig{})
+	if _, err := server.authenticate(context.Background(), "/Aviator/NotListed", nil); err == nil {
+		t.Fatal("an rpc without an access rule should be refused")
+	}
+}
+
+func TestSignedRequestCannotBeReplayed(t *testing.T) {
+	h := newHarness(t)
+	h.server.config.ApiKey, h.server.config.ApiSecret = "key", "secret"
+	method, req := "/Aviator/GetPlaneStatus", &aviator.GetPlaneStatusRequest{OrgID: testOrg}
+	timestamp := fmt.Sprint(time.Now().Unix())
+	signature, err := h.server.adminSignature(method, timestamp, "nonce-1", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", "key", "x-timestamp", timestamp, "x-nonce", "nonce-1", "x-signature", signature))
+	if _, err := h.server.authenticate(ctx, method, req); err != nil {
+		t.Fatalf("a signed request should be accepted: %v", err)
+	}
+	if _, err := h.server.authenticate(ctx, method, req); err == nil {
+		t.Fatal("a signed request should only be accepted once")
+	}
+}
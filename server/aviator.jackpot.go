@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/thedivinez/go-libs/messaging"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// getJackpot reads the org's jackpot, seeding it the first time it is needed.
+// Jackpots are held in the org's base currency.
+func (server *Server) getJackpot(settings *aviator.PlaneSettings) *aviator.Jackpot {
+	jackpot := &aviator.Jackpot{}
+	err := server.db.FindOne(JACKPOTS_COLLECTION, bson.M{"_id": settings.OrgID}, jackpot)
+	if err == nil {
+		return jackpot
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		server.log.Err(err).Msgf("failed to read jackpot for org %s", settings.OrgID)
+		return &aviator.Jackpot{OrgID: settings.OrgID, Currency: server.baseCurrency(settings)}
+	}
+	seed := server.takeJackpotSeed(context.Background(), settings.OrgID)
+	jackpot = &aviator.Jackpot{OrgID: settings.OrgID, Amount: seed, Currency: server.baseCurrency(settings)}
+	if _, err := server.db.InsertOne(JACKPOTS_COLLECTION, jackpot); err != nil {
+		server.log.Err(err).Msgf("failed to seed jackpot for org %s", settings.OrgID)
+		server.returnJackpotSeed(context.Background(), settings.OrgID, seed)
+	}
+	return jackpot
+}
+
+// takeJackpotSeed takes the seed of the org's jackpot from the amount to risk
+// of its base currency pool. A pool lower than the seed gives what it holds.
+func (server *Server) takeJackpotSeed(ctx context.Context, orgID string) int64 {
+	settings := server.getPlaneSettings(orgID)
+	base := server.baseCurrency(settings)
+	amountToRisk, _ := server.treasuryBalances(settings, base)
+	seed := min(settings.Jackpot.GetSeedAmount(), amountToRisk)
+	if seed <= 0 {
+		return 0
+	}
+	filter := bson.M{"orgId": orgID, fmt.Sprintf("treasuries.%s.amountToRisk", base): bson.M{"$gte": seed}}
+	update := server.treasuryUpdate(settings, base, "$inc", map[string]int64{"amountToRisk": -seed})
+	revision := primitive.NewObjectID().Hex()
+	update["$set"] = bson.M{"revision": revision}
+	if err := server.settingsStore.UpdateSettings(ctx, filter, update); err != nil {
+		server.log.Err(err).Msgf("failed to fund jackpot seed for org %s", orgID)
+		return 0
+	}
+	if written, err := server.settingsStore.GetRevision(ctx, orgID); err != nil || written != revision {
+		return 0
+	}
+	server.observeTreasury(orgID)
+	return seed
+}
+
+// returnJackpotSeed puts a seed that never made it into the jackpot back into the pool.
+func (server *Server) returnJackpotSeed(ctx context.Context, orgID string, seed int64) {
+	if seed <= 0 {
+		return
+	}
+	settings := server.getPlaneSettings(orgID)
+	update := server.treasuryUpdate(settings, server.baseCurrency(settings), "$inc", map[string]int64{"amountToRisk": seed})
+	if err := server.settingsStore.UpdateSettings(ctx, bson.M{"orgId": orgID}, update); err != nil {
+		server.log.Err(err).Msgf("failed to return jackpot seed for org %s", orgID)
+	}
+	server.observeTreasury(orgID)
+}
+
+// contributeToJackpot adds the jackpot's share of a live stake to the jackpot
+// and returns it in the currency of the bet.
+func (server *Server) contributeToJackpot(settings *aviator.PlaneSettings, bet *aviator.PlaneBet, stake int64) int64 {
+	if !settings.Jackpot.GetEnabled() || bet.Account != "live" {
+		return 0
+	}
+	contribution := scaleMinor(stake, settings.Jackpot.ContributionPercentage/100)
+	if contribution <= 0 {
+		return 0
+	}
+	baseContribution, err := server.toBase(settings, contribution, server.betCurrency(settings, bet))
+	if err != nil {
+		server.log.Err(err).Msgf("failed to value bet %s for the jackpot", bet.BetId)
+		return 0
+	}
+	server.getJackpot(settings)
+	if err := server.db.UpdateOne(JACKPOTS_COLLECTION, bson.M{"_id": settings.OrgID}, bson.M{"$inc": bson.M{"amount": baseContribution}}); err != nil {
+		server.log.Err(err).Msgf("failed to add to jackpot for org %s", settings.OrgID)
+		return 0
+	}
+	return contribution
+}
+
+// roundBettors returns the live bets of a round, both the ones still in the
+// flight and the ones already cashed out.
+func (server *Server) roundBettors(flight *aviator.Flight) []*aviator.PlaneBet {
+	bettors := []*aviator.PlaneBet{}
+	bets := liveBets(server.getPlaneBets(flight.OrgID, flight.ID))
+	for idx := range bets {
+		bettors = append(bettors, &bets[idx])
+	}
+	cashedOut := []*aviator.PlaneBet{}
+	if err := server.db.Find(BETS_COLLECTION, bson.M{"flightId": flight.ID, "account": "live"}, &cashedOut); err != nil {
+		server.log.Err(err).Msg("failed to read cashed out bets")
+	}
+	return append(bettors, cashedOut...)
+}
+
+// drawJackpot pays the jackpot to one of the round's bettors when the round
+// crashed above the trigger multiplier, or when the round wins the random draw.
+func (server *Server) drawJackpot(ctx context.Context, settings *aviator.PlaneSettings, flight *aviator.Flight) {
+	rules := settings.Jackpot
+	if !rules.GetEnabled() {
+		return
+	}
+	trigger := ""
+	if rules.TriggerMultiplier > 0 && flight.Multiplier-0.01 >= rules.TriggerMultiplier {
+		trigger = "multiplier"
+	} else if rules.DrawChance > 0 && server.random.Float(0, 1) < rules.DrawChance {
+		trigger = "draw"
+	}
+	if trigger == "" {
+		return
+	}
+	bettors := server.roundBettors(flight)
+	jackpot := server.getJackpot(settings)
+	if len(bettors) == 0 || jackpot.Amount <= 0 {
+		return
+	}
+
+	winner := bettors[server.random.Int(0, len(bettors))]
+	currency := server.betCurrency(settings, winner)
+	prize, err := server.fromBase(settings, jackpot.Amount, currency)
+	if err != nil {
+		server.log.Err(err).Msgf("failed to value jackpot for user %s", winner.UserID)
+		return
+	}
+	// the pool goes back to a seed taken from the treasury without losing
+	// stakes that came in meanwhile
+	seed := server.takeJackpotSeed(ctx, settings.OrgID)
+	update := bson.M{
+		"$inc": bson.M{"amount": seed - jackpot.Amount},
+		"$set": bson.M{"lastWinner": winner.UserID, "lastWonAmount": jackpot.Amount, "dateLastWon": server.clock.Now().Unix()},
+	}
+	if err := server.db.UpdateOne(JACKPOTS_COLLECTION, bson.M{"_id": settings.OrgID}, update); err != nil {
+		server.log.Err(err).Msgf("failed to reset jackpot for org %s", settings.OrgID)
+		server.returnJackpotSeed(ctx, settings.OrgID, seed)
+		return
+	}
+	if err := server.creditWallet(ctx, newWalletOp(winner, prize, WALLET_REASON_JACKPOT)); err != nil {
+		server.log.Err(err).Msgf("failed to credit jackpot to user %s", winner.UserID)
+	}
+	server.sendEvent(ctx, messaging.EventMessage{
+		Room:    "plane",
+		Service: "aviator",
+		OrgId:   settings.OrgID,
+		Event:   "jackpot:won",
+		Message: &aviator.JackpotWin{
+			Amount:   prize,
+			Trigger:  trigger,
+			Currency: currency,
+			FlightID: flight.ID,
+			OrgID:    settings.OrgID,
+			UserID:   winner.UserID,
+		},
+	})
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/thedivinez/go-libs/services/aviator"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestJackpotIsSeededFromTheTreasury(t *testing.T) {
+	h := newHarness(t)
+	rules := bson.M{"$set": bson.M{"jackpot": &aviator.JackpotSettings{Enabled: true, ContributionPercentage: 10, SeedAmount: 1000}}}
+	if err := h.server.settingsStore.UpdateSettings(context.Background(), bson.M{"orgId": testOrg}, rules); err != nil {
+		t.Fatal(err)
+	}
+	before := h.treasury().AmountToRisk
+	settings := h.server.getPlaneSettings(testOrg)
+	for range 2 {
+		if jackpot := h.server.getJackpot(settings); jackpot.Amount != 1000 {
+			t.Fatalf("the jackpot should be seeded with 1000 once, holds %d", jackpot.Amount)
+		}
+	}
+	if after := h.treasury().AmountToRisk; after != before-1000 {
+		t.Fatalf("the seed should come from the treasury, it went from %d to %d", before, after)
+	}
+	h.server.contributeToJackpot(settings, &aviator.PlaneBet{BetId: "bet-1", OrgID: testOrg, Account: "live", Currency: "USD"}, 500)
+	if jackpot := h.server.getJackpot(settings); jackpot.Amount != 1050 {
+		t.Fatalf("a tenth of the stake should go to the jackpot, it holds %d", jackpot.Amount)
+	}
+}
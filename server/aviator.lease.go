@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"github.com/thedivinez/go-libs/utils"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// roundsLease is the hold this instance has on the rounds of an org. It is
+// taken for ROUND_LEASE_TTL in the flight store and counted locally only until
+// ROUND_LEASE_RENEW before that, so the instance stops taking bets before
+// another one can pick the rounds up.
+type roundsLease struct {
+	claimedAt time.Time
+	ends      time.Time
+}
+
+type leaseRegistry struct {
+	sync.Mutex
+	orgs map[string]roundsLease
+}
+
+// peerRegistry keeps the connections to the instances bets are forwarded to.
+type peerRegistry struct {
+	sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+// roundsMethods are the rpcs that change the bets of a round, they are served
+// where the org's rounds run, with the reply each one answers.
+var roundsMethods = map[string]func() any{
+	"/Aviator/PlacePlaneBet":  func() any { return &aviator.PlacePlaneBetResponse{} },
+	"/Aviator/PlaneCashout":   func() any { return &aviator.PlaneCashoutResponse{} },
+	"/Aviator/CancelPlaneBet": func() any { return &aviator.CancelPlaneBetResponse{} },
+}
+
+// keepRounds reports whether this instance runs the rounds of the org. The
+// flight loop calls it every turn, it takes or extends the lease once the last
+// claim is ROUND_LEASE_RENEW old, so a stalled loop lets its rounds go.
+func (server *Server) keepRounds(orgID string) bool {
+	now := server.clock.Now()
+	server.leases.Lock()
+	lease, held := server.leases.orgs[orgID]
+	server.leases.Unlock()
+	if held && now.Before(lease.claimedAt.Add(ROUND_LEASE_RENEW)) {
+		return true
+	}
+	claimed, err := server.flightStore.ClaimRounds(context.Background(), orgID, server.roundsOwner(), ROUND_LEASE_TTL)
+	server.leases.Lock()
+	defer server.leases.Unlock()
+	if server.leases.orgs == nil {
+		server.leases.orgs = map[string]roundsLease{}
+	}
+	switch {
+	case err != nil:
+		// the lease may still be ours, it is kept until it runs out
+		server.planeFailed(orgID, err, "failed to claim the rounds")
+	case claimed:
+		server.leases.orgs[orgID] = roundsLease{claimedAt: now, ends: now.Add(ROUND_LEASE_TTL - ROUND_LEASE_RENEW)}
+	default:
+		delete(server.leases.orgs, orgID)
+	}
+	lease, held = server.leases.orgs[orgID]
+	return held && now.Before(lease.ends)
+}
+
+// ownsRounds reports whether this instance holds the lease on the rounds of
+// the org, without claiming it. The background jobs of an org run only on the
+// instance that runs its rounds.
+func (server *Server) ownsRounds(orgID string) bool {
+	server.leases.Lock()
+	defer server.leases.Unlock()
+	lease, held := server.leases.orgs[orgID]
+	return held && server.clock.Now().Before(lease.ends)
+}
+
+// checkRoundsOwner rejects a call that changes the bets of an org whose rounds
+// do not run here and that could not be forwarded to where they do, the client
+// retries once the lease has settled.
+func (server *Server) checkRoundsOwner(orgID string) error {
+	if !server.ownsRounds(orgID) {
+		return utils.NewServiceError(http.StatusServiceUnavailable, "the rounds of this org run on another instance, try again")
+	}
+	return nil
+}
+
+// roundsOwner names this instance in the lease, with the address the other
+// instances forward the bets of its orgs to.
+func (server *Server) roundsOwner() string {
+	return server.instanceID + "@" + server.config.AdvertiseAddress
+}
+
+// forwardToRounds passes a call of roundsMethods on to the instance that holds
+// the lease on the caller's org, with the caller's session, and reports whether
+// it did. Forwarded calls are never passed on again, while the lease moves they
+// are turned away by the handlers instead.
+func (server *Server) forwardToRounds(ctx context.Context, method string, req any) (any, bool, error) {
+	newReply, ok := roundsMethods[method]
+	if !ok || metadataValue(ctx, ROUNDS_FORWARDED_HEADER) != "" {
+		return nil, false, nil
+	}
+	user, err := userFromContext(ctx)
+	if err != nil || server.ownsRounds(user.OrgID) {
+		return nil, false, nil
+	}
+	owner, err := server.flightStore.RoundsOwner(ctx, user.OrgID)
+	if err != nil {
+		return nil, true, utils.NewServiceError(http.StatusServiceUnavailable, "failed to find the instance running the rounds of this org").WithInternal(err)
+	}
+	_, address, _ := strings.Cut(owner, "@")
+	if owner == server.roundsOwner() || address == "" {
+		return nil, true, server.checkRoundsOwner(user.OrgID)
+	}
+	conn, err := server.peerConn(address)
+	if err != nil {
+		return nil, true, utils.NewServiceError(http.StatusServiceUnavailable, "failed to reach the instance running the rounds of this org").WithInternal(err)
+	}
+	outgoing := metadata.Pairs(ROUNDS_FORWARDED_HEADER, server.instanceID)
+	for _, key := range []string{"authorization", "token"} {
+		if value := metadataValue(ctx, key); value != "" {
+			outgoing.Set(key, value)
+		}
+	}
+	reply := newReply()
+	if err := conn.Invoke(metadata.NewOutgoingContext(ctx, outgoing), method, req, reply); err != nil {
+		return nil, true, err
+	}
+	return reply, true, nil
+}
+
+// peerConn returns the connection to another instance, dialed once.
+func (server *Server) peerConn(address string) (*grpc.ClientConn, error) {
+	server.peers.Lock()
+	defer server.peers.Unlock()
+	if conn, ok := server.peers.conns[address]; ok {
+		return conn, nil
+	}
+	conn, err := server.dialPeer(address)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if server.peers.conns == nil {
+		server.peers.conns = map[string]*grpc.ClientConn{}
+	}
+	server.peers.conns[address] = conn
+	return conn, nil
+}
+
+func dialPeer(address string) (*grpc.ClientConn, error) {
+	return grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
+}
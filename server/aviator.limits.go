@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"github.com/thedivinez/go-libs/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func gamblingLimitsID(orgID, userID string) string {
+	return fmt.Sprintf("%s-%s", orgID, userID)
+}
+
+func gamblingSessionRedisKey(orgID, userID string) string {
+	return fmt.Sprintf("%s-rg:session-%s", orgID, userID)
+}
+
+// limitReachedError carries the limit that stopped the bet as the reason of the
+// error info, so clients can tell the player which limit applies.
+func limitReachedError(reason, message string, metadata map[string]string) error {
+	reached := status.New(codes.FailedPrecondition, message)
+	if detailed, err := reached.WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: GAMBLING_LIMITS_DOMAIN, Metadata: metadata}); err == nil {
+		return detailed.Err()
+	}
+	return reached.Err()
+}
+
+func (server *Server) getGamblingLimits(orgID, userID string) *aviator.GamblingLimits {
+	limits := &aviator.GamblingLimits{}
+	if err := server.db.FindOne(GAMBLING_LIMITS_COLLECTION, bson.M{"_id": gamblingLimitsID(orgID, userID)}, limits); err != nil {
+		return &aviator.GamblingLimits{ID: gamblingLimitsID(orgID, userID), OrgID: orgID, UserID: userID}
+	}
+	return limits
+}
+
+func validateGamblingLimits(limits *aviator.GamblingLimits) error {
+	for _, value := range []int64{limits.DailyLossLimit, limits.WeeklyLossLimit, limits.MonthlyLossLimit, limits.DailyWagerLimit, limits.SessionTimeLimit, limits.ExcludedUntil} {
+		if value < 0 {
+			return utils.NewServiceError(http.StatusBadRequest, "limits must not be negative")
+		}
+	}
+	return nil
+}
+
+// loosens reports whether a limit is raised or removed, zero meaning no limit.
+func loosens(current, requested int64) bool {
+	return current > 0 && (requested == 0 || requested > current)
+}
+
+// checkSelfImposedLimits lets players tighten their limits at once while raising
+// or removing one, or ending a self exclusion early, is left to the operator.
+func checkSelfImposedLimits(current, requested *aviator.GamblingLimits) error {
+	if loosens(current.DailyLossLimit, requested.DailyLossLimit) ||
+		loosens(current.WeeklyLossLimit, requested.WeeklyLossLimit) ||
+		loosens(current.MonthlyLossLimit, requested.MonthlyLossLimit) ||
+		loosens(current.DailyWagerLimit, requested.DailyWagerLimit) ||
+		loosens(current.SessionTimeLimit, requested.SessionTimeLimit) {
+		return utils.NewServiceError(http.StatusForbidden, "limits can only be lowered, contact support to raise or remove them")
+	}
+	if current.ExcludedUntil > time.Now().Unix() && requested.ExcludedUntil < current.ExcludedUntil {
+		return utils.NewServiceError(http.StatusForbidden, "a self exclusion cannot be shortened")
+	}
+	return nil
+}
+
+func (server *Server) saveGamblingLimits(limits *aviator.GamblingLimits, updatedBy string) (*aviator.GamblingLimits, error) {
+	limits.UpdatedBy = updatedBy
+	limits.DateUpdated = time.Now().Unix()
+	limits.ID = gamblingLimitsID(limits.OrgID, limits.UserID)
+	filter := bson.M{"_id": limits.ID}
+	if err := server.db.FindOne(GAMBLING_LIMITS_COLLECTION, filter, &aviator.GamblingLimits{}); err != nil {
+		if _, err := server.db.InsertOne(GAMBLING_LIMITS_COLLECTION, limits); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return limits, nil
+	}
+	if err := server.db.UpdateOne(GAMBLING_LIMITS_COLLECTION, filter, bson.M{"$set": limits}); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return limits, nil
+}
+
+// playerLedger sums the live stakes and net losses of the player from the given
+// time in base currency, from the wallet movements of their bets. Stakes of
+// bets still in the air count as lost until they are paid out.
+func (server *Server) playerLedger(settings *aviator.PlaneSettings, userID string, since time.Time) (map[string]int64, error) {
+	ops := []*aviator.WalletOp{}
+	filter := bson.M{
+		"userId":      userID,
+		"orgId":       settings.OrgID,
+		"target":      "live",
+		"status":      bson.M{"$in": []string{WALLET_OP_PENDING, WALLET_OP_DELIVERED}},
+		"reason":      bson.M{"$in": []string{WALLET_REASON_BET, WALLET_REASON_REFUND, WALLET_REASON_CASHOUT}},
+		"dateCreated": bson.M{"$gte": since.Unix()},
+	}
+	if err := server.db.Find(WALLET_OPS_COLLECTION, filter, &ops); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	now := time.Now().UTC()
+	periods := map[string]time.Time{
+		LIMIT_DAILY_LOSS:   now.Truncate(time.Hour * 24),
+		LIMIT_WEEKLY_LOSS:  now.Truncate(time.Hour * 24 * 7),
+		LIMIT_MONTHLY_LOSS: time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC),
+	}
+	ledger := map[string]int64{}
+	for _, op := range ops {
+		currency := op.AmountMoney.GetCurrency()
+		if currency == "" {
+			currency = server.config.Currency
+		}
+		amount, err := server.toBase(settings, server.moneyMinor(op.AmountMoney, op.Amount), currency)
+		if err != nil {
+			return nil, err
+		}
+		created := time.Unix(op.DateCreated, 0)
+		for limit, start := range periods {
+			if !created.Before(start) {
+				ledger[limit] -= amount
+			}
+		}
+		if op.Reason != WALLET_REASON_CASHOUT && !created.Before(periods[LIMIT_DAILY_LOSS]) {
+			ledger[LIMIT_DAILY_WAGER] -= amount
+		}
+	}
+	return ledger, nil
+}
+
+// checkGamblingLimits stops a live bet when the player is self excluded, has
+// played longer than their session limit or when the stake could take them past
+// a loss or wager limit. Free bets pass a zero stake since they cost nothing.
+func (server *Server) checkGamblingLimits(ctx context.Context, settings *aviator.PlaneSettings, userID string, stake int64) error {
+	limits := server.getGamblingLimits(settings.OrgID, userID)
+	now := time.Now()
+	if limits.ExcludedUntil > now.Unix() {
+		until := strconv.FormatInt(limits.ExcludedUntil, 10)
+		return limitReachedError(LIMIT_SELF_EXCLUDED, fmt.Sprintf("you are excluded from play until %s", time.Unix(limits.ExcludedUntil, 0).UTC().Format(time.RFC1123)), map[string]string{"excludedUntil": until})
+	}
+
+	sessionKey := gamblingSessionRedisKey(settings.OrgID, userID)
+	started, err := server.limitStore.StartSession(ctx, sessionKey, GAMBLING_SESSION_IDLE)
+	if err == nil && limits.SessionTimeLimit > 0 && now.Unix()-started.Unix() >= limits.SessionTimeLimit {
+		return limitReachedError(LIMIT_SESSION_TIME, fmt.Sprintf("you have reached your session limit, take a %s break", GAMBLING_SESSION_IDLE), nil)
+	}
+	if err := server.limitStore.ExtendSession(ctx, sessionKey, GAMBLING_SESSION_IDLE); err != nil {
+		server.log.Err(err).Msgf("failed to extend gambling session of %s", userID)
+	}
+
+	if limits.DailyLossLimit == 0 && limits.WeeklyLossLimit == 0 && limits.MonthlyLossLimit == 0 && limits.DailyWagerLimit == 0 {
+		return nil
+	}
+	utc := now.UTC()
+	since := time.Date(utc.Year(), utc.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if week := utc.Truncate(time.Hour * 24 * 7); week.Before(since) {
+		since = week
+	}
+	ledger, err := server.playerLedger(settings, userID, since)
+	if err != nil {
+		return utils.NewServiceError(http.StatusInternalServerError, "failed to check gambling limits").WithInternal(err)
+	}
+	for _, check := range []struct {
+		reason string
+		limit  int64
+	}{
+		{LIMIT_DAILY_LOSS, limits.DailyLossLimit},
+		{LIMIT_WEEKLY_LOSS, limits.WeeklyLossLimit},
+		{LIMIT_MONTHLY_LOSS, limits.MonthlyLossLimit},
+		{LIMIT_DAILY_WAGER, limits.DailyWagerLimit},
+	} {
+		reason, limit := check.reason, check.limit
+		if limit > 0 && ledger[reason]+stake > limit {
+			remaining := strconv.FormatInt(max(limit-ledger[reason], 0), 10)
+			return limitReachedError(reason, fmt.Sprintf("this bet would exceed your %s of %s", limitNames[reason], formatMoney(limit, server.baseCurrency(settings))), map[string]string{"remaining": remaining})
+		}
+	}
+	return nil
+}
+
+var limitNames = map[string]string{
+	LIMIT_DAILY_LOSS:   "daily loss limit",
+	LIMIT_WEEKLY_LOSS:  "weekly loss limit",
+	LIMIT_MONTHLY_LOSS: "monthly loss limit",
+	LIMIT_DAILY_WAGER:  "daily wager limit",
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/thedivinez/go-libs/messaging"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	roundsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aviator_rounds_total",
+		Help: "Rounds flown to explosion.",
+	}, []string{"org"})
+	tickLag = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aviator_tick_lag_seconds",
+		Help:    "How late the scheduler gave an org's round its turn.",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+	}, []string{"org"})
+	currentMultiplier = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aviator_multiplier",
+		Help: "Multiplier of the flight in the air.",
+	}, []string{"org"})
+	openBets = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aviator_open_bets",
+		Help: "Bets still riding on the flight in the air.",
+	}, []string{"org"})
+	stakesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aviator_stakes_minor_total",
+		Help: "Live stakes of rounds that took off, in minor units.",
+	}, []string{"org", "currency"})
+	payoutsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aviator_payouts_minor_total",
+		Help: "Live cashouts paid, in minor units.",
+	}, []string{"org", "currency"})
+	planeStalled = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aviator_plane_stalled",
+		Help: "1 when the flight loop of the org has not ticked within the stall timeout.",
+	}, []string{"org"})
+	realizedRTP = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aviator_realized_rtp",
+		Help: "Live payouts over live stakes in base currency since the instance started.",
+	}, []string{"org"})
+	treasuryPool = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aviator_treasury_minor",
+		Help: "Treasury pools of an org, in minor units.",
+	}, []string{"org", "currency", "pool"})
+	sendFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aviator_messaging_send_failures_total",
+		Help: "Events that could not be sent through messaging.",
+	}, []string{"event"})
+	schedulerBacklog = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "aviator_scheduler_backlog",
+		Help: "Due rounds waiting for a scheduler turn.",
+	})
+	bookReplicaBacklog = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "aviator_book_replica_backlog",
+		Help: "Bet book changes waiting to be written to the bet store.",
+	})
+	bookReplicaFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aviator_book_replica_failures_total",
+		Help: "Bet book changes and flight flushes the stores refused.",
+	}, []string{"op"})
+	authLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aviator_auth_call_seconds",
+		Help:    "Latency of calls to the auth service.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+)
+
+// rtpTotals keeps the base currency stakes and payouts behind the rtp gauge.
+var rtpTotals = struct {
+	sync.Mutex
+	stakes  map[string]int64
+	payouts map[string]int64
+}{stakes: map[string]int64{}, payouts: map[string]int64{}}
+
+func observeRTP(orgID string, stake, payout int64) {
+	rtpTotals.Lock()
+	defer rtpTotals.Unlock()
+	rtpTotals.stakes[orgID] += stake
+	rtpTotals.payouts[orgID] += payout
+	if rtpTotals.stakes[orgID] > 0 {
+		realizedRTP.WithLabelValues(orgID).Set(float64(rtpTotals.payouts[orgID]) / float64(rtpTotals.stakes[orgID]))
+	}
+}
+
+func (server *Server) observeStake(settings *aviator.PlaneSettings, currency string, stake int64) {
+	stakesTotal.WithLabelValues(settings.OrgID, currency).Add(float64(stake))
+	if baseStake, err := server.toBase(settings, stake, currency); err == nil {
+		observeRTP(settings.OrgID, baseStake, 0)
+	}
+}
+
+func (server *Server) observePayout(settings *aviator.PlaneSettings, currency string, payout int64) {
+	payoutsTotal.WithLabelValues(settings.OrgID, currency).Add(float64(payout))
+	if basePayout, err := server.toBase(settings, payout, currency); err == nil {
+		observeRTP(settings.OrgID, 0, basePayout)
+	}
+}
+
+func (server *Server) observeTreasury(orgID string) {
+	settings := server.getPlaneSettings(orgID)
+	currencies := []string{server.baseCurrency(settings)}
+	for currency := range settings.Treasuries {
+		currencies = append(currencies, currency)
+	}
+	for _, currency := range currencies {
+		amountToRisk, reservedBalance := server.treasuryBalances(settings, currency)
+		treasuryPool.WithLabelValues(orgID, currency, "amountToRisk").Set(float64(amountToRisk))
+		treasuryPool.WithLabelValues(orgID, currency, "reservedBalance").Set(float64(reservedBalance))
+	}
+}
+
+func observeAuthCall(method string, start time.Time, err error) {
+	authLatency.WithLabelValues(method, status.Code(err).String()).Observe(time.Since(start).Seconds())
+}
+
+// sendEvent sends an event through messaging and counts the ones that fail.
+func (server *Server) sendEvent(ctx context.Context, event messaging.EventMessage) {
+	_, span := startSpan(ctx, "messaging.Send", attribute.String("messaging.event", event.Event), attribute.String("messaging.room", event.Room))
+	err := server.messaging.Send(event)
+	if err != nil {
+		sendFailures.WithLabelValues(event.Event).Inc()
+		server.log.Err(err).Msgf("failed to send %s event", event.Event)
+	}
+	endSpan(span, err)
+}
+
+func (server *Server) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server.log.Log().Msgf("metrics listening on :%s", server.config.MetricsPort)
+	if err := http.ListenAndServe(fmt.Sprintf(":%s", server.config.MetricsPort), mux); err != nil {
+		server.log.Err(err).Msg("metrics listener stopped")
+	}
+}
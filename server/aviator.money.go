@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/thedivinez/go-libs/services/aviator"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Amounts are held in integer minor units of their currency. The double fields
+// are still written next to them, derived from the minor units, until every
+// reader has moved over to the money fields.
+
+// currencyExponents are the currencies whose minor unit is not a hundredth,
+// by their ISO 4217 exponent.
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0, "PYG": 0,
+	"RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+func currencyExponent(currency string) int {
+	if exponent, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return exponent
+	}
+	return 2
+}
+
+// minorScale is the number of minor units in one unit of the currency.
+func minorScale(currency string) float64 {
+	return math.Pow10(currencyExponent(currency))
+}
+
+// toMinor converts an amount of the currency, rounding half away from zero.
+func toMinor(amount float64, currency string) int64 {
+	return int64(math.Round(amount * minorScale(currency)))
+}
+
+func fromMinor(minor int64, currency string) float64 {
+	return float64(minor) / minorScale(currency)
+}
+
+// formatMoney writes an amount with as many decimals as its currency has.
+func formatMoney(minor int64, currency string) string {
+	return fmt.Sprintf("%s %s", strconv.FormatFloat(fromMinor(minor, currency), 'f', currencyExponent(currency), 64), currency)
+}
+
+// moneyMinor prefers the money field and falls back to the legacy amount for
+// records written before the money fields existed, which are all in the
+// currency the service is configured with.
+func (server *Server) moneyMinor(money *aviator.Money, legacy float64) int64 {
+	if money != nil {
+		return money.Minor
+	}
+	return toMinor(legacy, server.config.Currency)
+}
+
+func (server *Server) newMoney(minor int64) *aviator.Money {
+	return &aviator.Money{Minor: minor, Currency: server.config.Currency}
+}
+
+// payoutMinor pays the stake at the multiplier truncated to hundredths, and
+// rounds the result down to the minor unit, so a payout never exceeds the odds
+// shown to the player.
+func payoutMinor(stake int64, multiplier float64) int64 {
+	odds := int64(math.Floor(multiplier*ODDS_SCALE + 1e-9))
+	return stake * odds / ODDS_SCALE
+}
+
+// scaleMinor applies a ratio such as a risk percentage to an amount, rounding
+// half away from zero.
+func scaleMinor(amount int64, ratio float64) int64 {
+	return int64(math.Round(float64(amount) * ratio))
+}
+
+// migrateMoney fills in the money fields of settings that only have the legacy
+// double amounts, and moves the legacy pool into the base currency treasury.
+func (server *Server) migrateMoney() error {
+	ctx := context.Background()
+	clients, err := server.settingsStore.ListSettings(ctx, bson.M{"amountToRiskMoney": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	for _, client := range clients {
+		update := bson.M{"$set": bson.M{
+			"amountToRiskMoney":    server.newMoney(toMinor(client.AmountToRisk, server.config.Currency)),
+			"reservedBalanceMoney": server.newMoney(toMinor(client.ReservedBalance, server.config.Currency)),
+		}}
+		if err := server.settingsStore.UpdateSettings(ctx, bson.M{"orgId": client.OrgID}, update); err != nil {
+			return err
+		}
+	}
+	if clients, err = server.settingsStore.ListSettings(ctx, bson.M{"treasuries": bson.M{"$exists": false}}); err != nil {
+		return err
+	}
+	for _, client := range clients {
+		base := server.baseCurrency(client)
+		amountToRisk, reservedBalance := server.treasuryBalances(client, base)
+		update := bson.M{"$set": bson.M{"treasuries": map[string]*aviator.Treasury{
+			base: {AmountToRisk: amountToRisk, ReservedBalance: reservedBalance},
+		}}}
+		if err := server.settingsStore.UpdateSettings(ctx, bson.M{"orgId": client.OrgID}, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
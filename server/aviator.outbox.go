@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thedivinez/go-libs/services/auth"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newWalletOp(bet *aviator.PlaneBet, minor int64, reason string) *aviator.WalletOp {
+	currency := bet.StakeMoney.GetCurrency()
+	return &aviator.WalletOp{
+		Reason:      reason,
+		OrgID:       bet.OrgID,
+		UserID:      bet.UserID,
+		BetID:       bet.BetId,
+		Target:      bet.Account,
+		Amount:      fromMinor(minor, currency),
+		AmountMoney: &aviator.Money{Minor: minor, Currency: currency},
+	}
+}
+
+func walletOpBackoff(attempts int64) time.Duration {
+	backoff := WALLET_OP_BASE_BACKOFF
+	for i := int64(1); i < attempts && backoff < WALLET_OP_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	return min(backoff, WALLET_OP_MAX_BACKOFF)
+}
+
+// queueWalletOp records the movement in the outbox before anything is sent to
+// the auth service, so a crash or a failed call can never lose it. An op that
+// already has an id keeps it, queueing it twice fails with a duplicate key.
+func (server *Server) queueWalletOp(op *aviator.WalletOp) error {
+	now := time.Now()
+	op.Attempts = 0
+	op.Status = WALLET_OP_PENDING
+	op.DateCreated = now.Unix()
+	if op.ID == "" {
+		op.ID = primitive.NewObjectID().Hex()
+	}
+	// keep the dispatcher away while the caller makes the first attempt itself
+	op.NextAttempt = now.Add(WALLET_OP_DELIVER_LIMIT).Unix()
+	if _, err := server.db.InsertOne(WALLET_OPS_COLLECTION, op); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (server *Server) updateWalletOp(op *aviator.WalletOp) {
+	update := bson.M{"$set": bson.M{
+		"status":        op.Status,
+		"attempts":      op.Attempts,
+		"lastError":     op.LastError,
+		"nextAttempt":   op.NextAttempt,
+		"dateDelivered": op.DateDelivered,
+		"void":          op.Void,
+	}}
+	if err := server.db.UpdateOne(WALLET_OPS_COLLECTION, bson.M{"_id": op.ID}, update); err != nil {
+		server.log.Err(err).Msgf("failed to update wallet op %s", op.ID)
+	}
+}
+
+// walletOutcomeUnknown tells whether a failed call may still have been applied
+// by the auth service, as opposed to being refused.
+func walletOutcomeUnknown(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return true
+	}
+	switch status.Code(errors.Cause(err)) {
+	case codes.DeadlineExceeded, codes.Canceled, codes.Unavailable, codes.Unknown:
+		return true
+	}
+	return false
+}
+
+// refundVoidDebit queues the refund of a debit whose bet was never placed. The
+// refund is keyed on the debit, so confirming the debit again queues it once.
+func (server *Server) refundVoidDebit(op *aviator.WalletOp) error {
+	refund := &aviator.WalletOp{
+		ID:          op.ID + "-refund",
+		Reason:      WALLET_REASON_REFUND,
+		OrgID:       op.OrgID,
+		UserID:      op.UserID,
+		BetID:       op.BetID,
+		Target:      op.Target,
+		Amount:      -op.Amount,
+		AmountMoney: &aviator.Money{Minor: -op.AmountMoney.GetMinor(), Currency: op.AmountMoney.GetCurrency()},
+	}
+	if err := server.queueWalletOp(refund); err != nil && !mongo.IsDuplicateKeyError(errors.Cause(err)) {
+		return err
+	}
+	return nil
+}
+
+// deliverWalletOp makes one attempt to apply the movement on the auth service and
+// schedules the next attempt with exponential backoff when it fails. The op id
+// goes along as the idempotency key, so an attempt that timed out after the auth
+// service applied it is not applied again.
+func (server *Server) deliverWalletOp(ctx context.Context, op *aviator.WalletOp) error {
+	ctx, cancel := context.WithTimeout(ctx, WALLET_OP_DELIVER_LIMIT)
+	defer cancel()
+	ctx, done := startAuthCall(ctx, "AddToAccountBalance")
+	_, err := server.auth.AddToAccountBalance(ctx, &auth.AddToAccountBalanceRequest{
+		OrgID:          op.OrgID,
+		Amount:         op.Amount,
+		UserId:         op.UserID,
+		Target:         op.Target,
+		Source:         server.config.ServiceName,
+		IdempotencyKey: op.ID,
+	})
+	done(err)
+	op.Attempts++
+	if err == nil && op.Void {
+		err = server.refundVoidDebit(op)
+	}
+	if err == nil {
+		op.LastError = ""
+		op.Status = WALLET_OP_DELIVERED
+		op.DateDelivered = time.Now().Unix()
+		server.updateWalletOp(op)
+		return nil
+	}
+	op.LastError = err.Error()
+	if op.Void && !walletOutcomeUnknown(err) {
+		// refused under the same key, so the first attempt was never applied
+		op.Status = WALLET_OP_REJECTED
+	} else if op.Attempts >= WALLET_OP_MAX_ATTEMPTS {
+		op.Status = WALLET_OP_DEAD
+	} else {
+		op.NextAttempt = time.Now().Add(walletOpBackoff(op.Attempts)).Unix()
+	}
+	server.updateWalletOp(op)
+	return errors.WithStack(err)
+}
+
+// creditWallet succeeds once the credit is either confirmed or safely queued for
+// the dispatcher to retry.
+func (server *Server) creditWallet(ctx context.Context, op *aviator.WalletOp) error {
+	if err := server.queueWalletOp(op); err != nil {
+		return err
+	}
+	if err := server.deliverWalletOp(ctx, op); err != nil {
+		server.log.Err(err).Msgf("wallet op %s queued for retry", op.ID)
+	}
+	return nil
+}
+
+// debitWallet only succeeds when the auth service confirms the debit. A refused
+// debit is never retried since the bet it paid for is not placed. A debit that
+// timed out may have been applied, it stays pending as void: the dispatcher
+// retries it under the same key until the auth service confirms or refuses it,
+// and a confirmed void debit is refunded.
+func (server *Server) debitWallet(ctx context.Context, op *aviator.WalletOp) error {
+	if err := server.queueWalletOp(op); err != nil {
+		return err
+	}
+	if err := server.deliverWalletOp(ctx, op); err != nil {
+		if op.Void = walletOutcomeUnknown(err); !op.Void {
+			op.Status = WALLET_OP_REJECTED
+		}
+		server.updateWalletOp(op)
+		return err
+	}
+	return nil
+}
+
+// deliverDueWalletOps makes the next attempt at every pending op that is due.
+func (server *Server) deliverDueWalletOps() {
+	ops := []*aviator.WalletOp{}
+	filter := bson.M{"status": WALLET_OP_PENDING, "nextAttempt": bson.M{"$lte": time.Now().Unix()}}
+	if err := server.db.Find(WALLET_OPS_COLLECTION, filter, &ops); err != nil {
+		server.log.Err(err).Msg("failed to read pending wallet ops")
+		return
+	}
+	for idx := range ops {
+		if err := server.deliverWalletOp(context.Background(), ops[idx]); err != nil {
+			server.log.Err(err).Msgf("failed to deliver wallet op %s (attempt %d)", ops[idx].ID, ops[idx].Attempts)
+		}
+	}
+}
+
+func (server *Server) dispatchWalletOps() {
+	for range time.NewTicker(WALLET_DISPATCH_EVERY).C {
+		server.deliverDueWalletOps()
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/thedivinez/go-libs/services/aviator"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestTimedOutDebitIsRefunded(t *testing.T) {
+	h := newHarness(t, "frank")
+	h.auth.Lock()
+	h.auth.timeout = true
+	h.auth.Unlock()
+	bet := &aviator.PlaneBet{BetId: "bet-1", OrgID: testOrg, UserID: "frank", Account: "live", StakeMoney: money(500, "USD")}
+	if err := h.server.debitWallet(context.Background(), newWalletOp(bet, -500, WALLET_REASON_BET)); err == nil {
+		t.Fatal("a debit that timed out should fail")
+	}
+	if got := h.auth.balance(t, "frank"); got != 95 {
+		t.Fatalf("the timed out debit was applied, frank should have 95, has %v", got)
+	}
+	ops := []*aviator.WalletOp{}
+	if err := h.server.db.Find(WALLET_OPS_COLLECTION, bson.M{}, &ops); err != nil || len(ops) != 1 || ops[0].Status != WALLET_OP_PENDING || !ops[0].Void {
+		t.Fatalf("the debit should stay pending as void, got %v (%v)", ops, err)
+	}
+	deliver := func() {
+		if err := h.server.db.UpdateOne(WALLET_OPS_COLLECTION, bson.M{"status": WALLET_OP_PENDING}, bson.M{"$set": bson.M{"nextAttempt": 0}}); err != nil {
+			t.Fatal(err)
+		}
+		h.server.deliverDueWalletOps()
+	}
+	// confirming the debit under its key does not debit again, it queues the refund
+	deliver()
+	if got := h.auth.balance(t, "frank"); got != 95 {
+		t.Fatalf("confirming the debit should not apply it twice, frank has %v", got)
+	}
+	deliver()
+	deliver()
+	if got := h.auth.balance(t, "frank"); got != 100 {
+		t.Fatalf("the void debit should be refunded once, frank has %v", got)
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/thedivinez/go-libs/services/aviator"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// rateLimitedMethods are the betting rpcs with a token bucket, with the budget
+// used when the org has not set one in its plane settings.
+var rateLimitedMethods = map[string]*aviator.RateLimit{
+	"PlacePlaneBet":  defaultRateLimit(),
+	"CancelPlaneBet": defaultRateLimit(),
+	"PlaneCashout":   defaultRateLimit(),
+}
+
+func defaultRateLimit() *aviator.RateLimit {
+	return &aviator.RateLimit{
+		Capacity:           RATE_LIMIT_CAPACITY,
+		RefillPerSecond:    RATE_LIMIT_REFILL,
+		OrgCapacity:        RATE_LIMIT_ORG_CAPACITY,
+		OrgRefillPerSecond: RATE_LIMIT_ORG_REFILL,
+	}
+}
+
+func userRateLimitRedisKey(orgID, userID, method string) string {
+	return fmt.Sprintf("%s-ratelimit:%s-%s", orgID, method, userID)
+}
+
+func orgRateLimitRedisKey(orgID, method string) string {
+	return fmt.Sprintf("%s-ratelimit:%s", orgID, method)
+}
+
+func rateLimitedError(method string, wait time.Duration) error {
+	exhausted := status.New(codes.ResourceExhausted, fmt.Sprintf("too many %s requests, retry in %s", method, wait))
+	if detailed, err := exhausted.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)}); err == nil {
+		return detailed.Err()
+	}
+	return exhausted.Err()
+}
+
+// rateLimit takes a token from the caller's bucket and from the org's bucket of
+// the rpc. A budget set in the settings of the current round replaces the
+// default one and a zero capacity turns that bucket off. Calls go through when
+// the store is down.
+func (server *Server) rateLimit(ctx context.Context, fullMethod string) error {
+	method := strings.TrimPrefix(fullMethod, "/Aviator/")
+	budget, ok := rateLimitedMethods[method]
+	if !ok {
+		return nil
+	}
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil
+	}
+	if limit, ok := server.roundSettings(user.OrgID).RateLimits[method]; ok {
+		budget = limit
+	}
+	buckets := []tokenBucket{}
+	if budget.Capacity > 0 {
+		buckets = append(buckets, tokenBucket{userRateLimitRedisKey(user.OrgID, user.ID, method), budget.Capacity, budget.RefillPerSecond})
+	}
+	if budget.OrgCapacity > 0 {
+		buckets = append(buckets, tokenBucket{orgRateLimitRedisKey(user.OrgID, method), budget.OrgCapacity, budget.OrgRefillPerSecond})
+	}
+	if len(buckets) == 0 {
+		return nil
+	}
+	allowed, wait, err := server.limitStore.TakeToken(ctx, buckets)
+	if err != nil {
+		server.log.Err(err).Msgf("failed to rate limit %s", method)
+		return nil
+	}
+	if allowed {
+		return nil
+	}
+	return rateLimitedError(method, wait)
+}
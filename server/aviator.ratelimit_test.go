@@ -0,0 +1,25 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/thedivinez/go-libs/services/auth"
+	"github.com/thedivinez/go-libs/services/aviator"
+)
+
+func TestRateLimitUsesTheRoundSettings(t *testing.T) {
+	h := newHarness(t)
+	ctx := context.WithValue(context.Background(), userContextKey{}, &auth.User{ID: "kate", OrgID: testOrg})
+	limits := map[string]*aviator.RateLimit{"PlacePlaneBet": {Capacity: 1, RefillPerSecond: 0.001}}
+	h.server.planeTicked(&aviator.Flight{ID: "flight-1", OrgID: testOrg, State: STATE_LOADING, Settings: &aviator.PlaneSettings{OrgID: testOrg, RateLimits: limits}})
+	if err := h.server.rateLimit(ctx, "/Aviator/PlacePlaneBet"); err != nil {
+		t.Fatalf("the first bet should go through: %v", err)
+	}
+	if err := h.server.rateLimit(ctx, "/Aviator/PlacePlaneBet"); err == nil {
+		t.Fatal("the budget of the round should limit the second bet")
+	}
+	if budget := rateLimitedMethods["PlaneCashout"]; budget.OrgCapacity == 0 || budget.OrgRefillPerSecond == 0 {
+		t.Fatal("the org should have a bucket by default")
+	}
+}
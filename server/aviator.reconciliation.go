@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thedivinez/go-libs/services/auth"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func reconciliationID(orgID, day string) string {
+	return fmt.Sprintf("%s-%s", orgID, day)
+}
+
+// ledgerEntries reads the live movements the auth service recorded for the org
+// with this service as source between from and to.
+func (server *Server) ledgerEntries(ctx context.Context, orgID string, from, to time.Time) ([]*auth.LedgerEntry, error) {
+	entries := []*auth.LedgerEntry{}
+	for page := 1; ; page++ {
+		authCtx, done := startAuthCall(ctx, "ListLedgerEntries")
+		found, err := server.auth.ListLedgerEntries(authCtx, &auth.ListLedgerEntriesRequest{
+			OrgID:  orgID,
+			Target: "live",
+			Source: server.config.ServiceName,
+			From:   from.Unix(),
+			To:     to.Unix(),
+			Page:   strconv.Itoa(page),
+			Limit:  RECONCILE_LEDGER_PAGE,
+		})
+		done(err)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		entries = append(entries, found.Entries...)
+		if len(found.Entries) < RECONCILE_LEDGER_PAGE {
+			return entries, nil
+		}
+	}
+}
+
+// reconcileDay compares the live bets settled on day against the movements the
+// auth service's ledger recorded for them. Every movement is sent with its
+// wallet op id as idempotency key, which ties a ledger entry to its bet. The
+// ledger is read until RECONCILE_GRACE past the day so that the payouts of
+// bets placed just before midnight are counted. Items are in the currency of
+// their bet, the totals in the org's base currency.
+func (server *Server) reconcileDay(ctx context.Context, orgID string, day time.Time) (*aviator.Reconciliation, error) {
+	start := day.UTC().Truncate(time.Hour * 24)
+	end := start.Add(time.Hour * 24)
+	report := &aviator.Reconciliation{
+		OrgID:       orgID,
+		Day:         start.Format(RECONCILE_DAY),
+		DateCreated: time.Now().Unix(),
+		Items:       []*aviator.ReconciliationItem{},
+	}
+	report.ID = reconciliationID(orgID, report.Day)
+
+	bets := []*aviator.PlaneBet{}
+	betsFilter := bson.M{"orgId": orgID, "account": "live", "dateCreated": bson.M{"$gte": start.Unix(), "$lt": end.Unix()}}
+	if err := server.db.Find(BETS_COLLECTION, betsFilter, &bets); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	settled := map[string]bool{}
+	for _, bet := range bets {
+		settled[bet.BetId] = true
+	}
+
+	entries, err := server.ledgerEntries(ctx, orgID, start, end.Add(RECONCILE_GRACE))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, entry.IdempotencyKey)
+	}
+	ops := []*aviator.WalletOp{}
+	if err := server.db.Find(WALLET_OPS_COLLECTION, bson.M{"_id": bson.M{"$in": keys}}, &ops); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	opsByID := map[string]*aviator.WalletOp{}
+	for _, op := range ops {
+		opsByID[op.ID] = op
+	}
+	debited, credited := map[string]int64{}, map[string]int64{}
+	unsettled := []*auth.LedgerEntry{}
+	for _, entry := range entries {
+		op, ok := opsByID[entry.IdempotencyKey]
+		if !ok || !settled[op.BetID] {
+			// what the grace adds only counts for the bets of the day
+			if entry.DateCreated < end.Unix() {
+				unsettled = append(unsettled, entry)
+			}
+			continue
+		}
+		switch op.Reason {
+		case WALLET_REASON_BET, WALLET_REASON_REFUND:
+			debited[op.BetID] -= toMinor(entry.Amount, op.AmountMoney.GetCurrency())
+		case WALLET_REASON_CASHOUT:
+			credited[op.BetID] += toMinor(entry.Amount, op.AmountMoney.GetCurrency())
+		}
+	}
+
+	settings := server.getPlaneSettings(orgID)
+	totals := make([]int64, 4)
+	for _, bet := range bets {
+		currency := server.betCurrency(settings, bet)
+		stake, payout := server.moneyMinor(bet.StakeMoney, bet.Stake), server.moneyMinor(bet.PayoutMoney, bet.Payout)
+		if bet.FreeBetID != "" {
+			// free bets are never debited, their payout is the winnings only
+			stake = 0
+		}
+		report.Bets++
+		for idx, amount := range []int64{stake, payout, debited[bet.BetId], credited[bet.BetId]} {
+			base, err := server.toBase(settings, amount, currency)
+			if err != nil {
+				return nil, err
+			}
+			totals[idx] += base
+		}
+		if stake != debited[bet.BetId] {
+			report.Items = append(report.Items, &aviator.ReconciliationItem{
+				Kind:     "stake",
+				BetID:    bet.BetId,
+				UserID:   bet.UserID,
+				Expected: fromMinor(stake, currency),
+				Actual:   fromMinor(debited[bet.BetId], currency),
+			})
+		}
+		if payout != credited[bet.BetId] {
+			report.Items = append(report.Items, &aviator.ReconciliationItem{
+				Kind:     "payout",
+				BetID:    bet.BetId,
+				UserID:   bet.UserID,
+				Expected: fromMinor(payout, currency),
+				Actual:   fromMinor(credited[bet.BetId], currency),
+			})
+		}
+	}
+	base := server.baseCurrency(settings)
+	report.TotalStakes, report.TotalPayouts = fromMinor(totals[0], base), fromMinor(totals[1], base)
+	report.TotalDebited, report.TotalCredited = fromMinor(totals[2], base), fromMinor(totals[3], base)
+	server.reconcileOrphans(unsettled, opsByID, report)
+	return report, nil
+}
+
+// reconcileOrphans reports ledger entries of the day that belong to no settled
+// bet, ignoring refunded bets whose movements cancel out and the movements
+// that are not bets, like jackpot or cashback credits.
+func (server *Server) reconcileOrphans(entries []*auth.LedgerEntry, ops map[string]*aviator.WalletOp, report *aviator.Reconciliation) {
+	net, users, currencies := map[string]int64{}, map[string]string{}, map[string]string{}
+	for _, entry := range entries {
+		op, ok := ops[entry.IdempotencyKey]
+		if !ok {
+			// a movement we have no record of sending
+			report.Items = append(report.Items, &aviator.ReconciliationItem{
+				Kind:     "orphan",
+				Actual:   entry.Amount,
+				UserID:   entry.UserId,
+				Expected: 0,
+			})
+			continue
+		}
+		if !slices.Contains([]string{WALLET_REASON_BET, WALLET_REASON_REFUND, WALLET_REASON_CASHOUT}, op.Reason) {
+			continue
+		}
+		net[op.BetID] += toMinor(entry.Amount, op.AmountMoney.GetCurrency())
+		users[op.BetID], currencies[op.BetID] = op.UserID, op.AmountMoney.GetCurrency()
+	}
+	for betID, amount := range net {
+		if amount == 0 {
+			continue
+		}
+		// the bet may have been settled on another day
+		if err := server.db.FindOne(BETS_COLLECTION, bson.M{"_id": betID}, &aviator.PlaneBet{}); err == nil {
+			continue
+		}
+		report.Items = append(report.Items, &aviator.ReconciliationItem{
+			Kind:     "orphan",
+			BetID:    betID,
+			Actual:   fromMinor(amount, currencies[betID]),
+			UserID:   users[betID],
+			Expected: 0,
+		})
+	}
+}
+
+func (server *Server) saveReconciliation(report *aviator.Reconciliation) error {
+	if err := server.db.FindOne(RECONCILIATIONS_COLLECTION, bson.M{"_id": report.ID}, &aviator.Reconciliation{}); err != nil {
+		_, err := server.db.InsertOne(RECONCILIATIONS_COLLECTION, report)
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(server.db.UpdateOne(RECONCILIATIONS_COLLECTION, bson.M{"_id": report.ID}, bson.M{"$set": report}))
+}
+
+// unreconciledDays lists the days of an org from the one after its last saved
+// report up to yesterday. An org without a report owes only yesterday, and the
+// catch up goes back RECONCILE_MAX_DAYS at most.
+func (server *Server) unreconciledDays(orgID string, yesterday time.Time) ([]time.Time, error) {
+	last := []*aviator.Reconciliation{}
+	if err := server.db.GetPage(RECONCILIATIONS_COLLECTION, bson.M{"orgId": orgID}, "1", 1, -1, &last); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	from := yesterday
+	if len(last) > 0 {
+		if day, err := time.Parse(RECONCILE_DAY, last[0].Day); err == nil {
+			from = day.AddDate(0, 0, 1)
+		}
+	}
+	if earliest := yesterday.AddDate(0, 0, -RECONCILE_MAX_DAYS); from.Before(earliest) {
+		from = earliest
+	}
+	days := []time.Time{}
+	for day := from; !day.After(yesterday); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+// runReconciliations reconciles every org up to the previous day once it is
+// over, days missed while the job was down are caught up on in order.
+func (server *Server) runReconciliations() {
+	ticker := time.NewTicker(RECONCILE_EVERY)
+	for ; ; <-ticker.C {
+		clients, err := server.settingsStore.ListSettings(context.Background(), bson.M{})
+		if err != nil {
+			server.log.Err(err).Msg("failed to read clients for reconciliation")
+			continue
+		}
+		// the ledger of yesterday is read until the grace has passed
+		today := time.Now().UTC().Truncate(time.Hour * 24)
+		if time.Now().Before(today.Add(RECONCILE_GRACE)) {
+			continue
+		}
+		for _, client := range clients {
+			if !server.ownsRounds(client.OrgID) {
+				continue
+			}
+			days, err := server.unreconciledDays(client.OrgID, today.AddDate(0, 0, -1))
+			if err != nil {
+				server.log.Err(err).Msgf("failed to find the days to reconcile for org %s", client.OrgID)
+				continue
+			}
+			// a day that fails stops the catch up, the next run starts from it again
+			for _, day := range days {
+				report, err := server.reconcileDay(context.Background(), client.OrgID, day)
+				if err != nil {
+					server.log.Err(err).Msgf("failed to reconcile org %s", client.OrgID)
+					break
+				}
+				if err := server.saveReconciliation(report); err != nil {
+					server.log.Err(err).Msgf("failed to save reconciliation %s", report.ID)
+					break
+				}
+			}
+		}
+	}
+}
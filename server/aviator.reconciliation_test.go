@@ -0,0 +1,24 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thedivinez/go-libs/services/aviator"
+)
+
+func TestReconciliationCatchesUpOnMissedDays(t *testing.T) {
+	h := newHarness(t)
+	yesterday := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	days, err := h.server.unreconciledDays(testOrg, yesterday)
+	if err != nil || len(days) != 1 || !days[0].Equal(yesterday) {
+		t.Fatalf("an org without reports owes only yesterday, got %v (%v)", days, err)
+	}
+	if _, err := h.server.db.InsertOne(RECONCILIATIONS_COLLECTION, &aviator.Reconciliation{ID: reconciliationID(testOrg, "2024-03-07"), OrgID: testOrg, Day: "2024-03-07"}); err != nil {
+		t.Fatal(err)
+	}
+	days, err = h.server.unreconciledDays(testOrg, yesterday)
+	if err != nil || len(days) != 3 || days[0].Format(RECONCILE_DAY) != "2024-03-08" || !days[2].Equal(yesterday) {
+		t.Fatalf("the days after the last report should be reconciled, got %v (%v)", days, err)
+	}
+}
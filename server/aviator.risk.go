@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"github.com/thedivinez/go-libs/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// betPattern is what a player did over the scan window.
+type betPattern struct {
+	bets        int64
+	cashouts    int64
+	offsets     []float64
+	stakes      map[string]int64
+	multipliers map[string]int64
+}
+
+func playerRiskID(orgID, userID string) string {
+	return fmt.Sprintf("%s-%s", orgID, userID)
+}
+
+func riskThrottleRedisKey(orgID, userID string) string {
+	return fmt.Sprintf("%s-risk:throttle-%s", orgID, userID)
+}
+
+// riskAction blocks only players whose cashouts were timed like a bot's, a
+// score made of betting habits alone is at most throttled.
+func riskAction(score float64, timed bool) string {
+	switch {
+	case score >= RISK_BLOCK_SCORE && timed:
+		return RISK_BLOCK
+	case score >= RISK_THROTTLE_SCORE:
+		return RISK_THROTTLE
+	}
+	return RISK_NONE
+}
+
+func meanAndSpread(values []float64) (float64, float64) {
+	mean, variance := 0.0, 0.0
+	for _, value := range values {
+		mean += value
+	}
+	mean /= float64(len(values))
+	for _, value := range values {
+		variance += (value - mean) * (value - mean)
+	}
+	return mean, math.Sqrt(variance / float64(len(values)))
+}
+
+func mostCommon[K comparable](counts map[K]int64) (K, int64) {
+	var common K
+	best := int64(0)
+	for key, count := range counts {
+		if count > best {
+			common, best = key, count
+		}
+	}
+	return common, best
+}
+
+// scoreOrgRisk looks for bots in the live bets of the window: cashouts that
+// land the same number of milliseconds after a tick, accounts that cash out
+// together at many different multipliers, a fixed cashout multiplier and
+// accounts that play the same strategy. Identical stakes and targets are
+// common among players and never link accounts on their own.
+func (server *Server) scoreOrgRisk(orgID string, now time.Time) (*aviator.OrgRisk, map[string]*aviator.PlayerRisk, error) {
+	bets := []*aviator.PlaneBet{}
+	filter := bson.M{
+		"orgId":       orgID,
+		"account":     "live",
+		"freeBetId":   bson.M{"$in": []any{"", nil}},
+		"dateCreated": bson.M{"$gte": now.Add(-RISK_WINDOW).Unix()},
+	}
+	if err := server.db.Find(BETS_COLLECTION, filter, &bets); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	type cashout struct {
+		userID     string
+		at         int64
+		multiplier string
+	}
+	patterns, roundCashouts := map[string]*betPattern{}, map[string][]cashout{}
+	for _, bet := range bets {
+		pattern, ok := patterns[bet.UserID]
+		if !ok {
+			pattern = &betPattern{stakes: map[string]int64{}, multipliers: map[string]int64{}}
+			patterns[bet.UserID] = pattern
+		}
+		stake, payout := server.moneyMinor(bet.StakeMoney, bet.Stake), server.moneyMinor(bet.PayoutMoney, bet.Payout)
+		pattern.bets++
+		currency := bet.StakeMoney.GetCurrency()
+		if currency == "" {
+			currency = server.config.Currency
+		}
+		pattern.stakes[formatMoney(stake, currency)]++
+		if payout > 0 && stake > 0 {
+			multiplier := fmt.Sprintf("%.2f", float64(payout*100/stake)/100)
+			pattern.cashouts++
+			pattern.multipliers[multiplier]++
+			if bet.CashedOutAt > 0 {
+				pattern.offsets = append(pattern.offsets, float64(bet.TickOffset))
+				roundCashouts[bet.FlightID] = append(roundCashouts[bet.FlightID], cashout{bet.UserID, bet.CashedOutAt, multiplier})
+			}
+		}
+	}
+
+	risks, timed := map[string]*aviator.PlayerRisk{}, map[string]bool{}
+	flag := func(userID string, score float64, reason string) {
+		risk, ok := risks[userID]
+		if !ok {
+			risk = &aviator.PlayerRisk{ID: playerRiskID(orgID, userID), OrgID: orgID, UserID: userID, Reasons: []string{}}
+			risks[userID] = risk
+		}
+		risk.Score = min(risk.Score+score, 100)
+		risk.Reasons = append(risk.Reasons, reason)
+	}
+
+	strategies := map[string][]string{}
+	for userID, pattern := range patterns {
+		if len(pattern.offsets) >= RISK_MIN_BETS {
+			if mean, spread := meanAndSpread(pattern.offsets); spread < RISK_TIMING_SPREAD {
+				flag(userID, 40, fmt.Sprintf("cashouts land %.0fms after a tick within %.1fms", mean, spread))
+				timed[userID] = true
+			}
+		}
+		if pattern.cashouts < RISK_MIN_BETS {
+			continue
+		}
+		multiplier, count := mostCommon(pattern.multipliers)
+		if float64(count)/float64(pattern.cashouts) < RISK_FIXED_SHARE {
+			continue
+		}
+		flag(userID, 20, fmt.Sprintf("cashes out at %sx on %d of %d bets", multiplier, count, pattern.cashouts))
+		stake, _ := mostCommon(pattern.stakes)
+		strategy := fmt.Sprintf("%s at %sx", stake, multiplier)
+		strategies[strategy] = append(strategies[strategy], userID)
+	}
+	for strategy, users := range strategies {
+		if len(users) >= RISK_CLUSTER_SIZE {
+			for _, userID := range users {
+				flag(userID, 20, fmt.Sprintf("plays %s like %d other accounts", strategy, len(users)-1))
+			}
+		}
+	}
+
+	// accounts that cash out within RISK_CASHOUT_GAP of each other, counted by
+	// the distinct multipliers they did it at, so that players sharing a
+	// popular auto cashout target are not linked
+	shared := map[string]map[string]map[string]bool{}
+	for _, cashouts := range roundCashouts {
+		for _, a := range cashouts {
+			for _, b := range cashouts {
+				if a.userID == b.userID || math.Abs(float64(a.at-b.at)) > RISK_CASHOUT_GAP {
+					continue
+				}
+				if shared[a.userID] == nil {
+					shared[a.userID] = map[string]map[string]bool{}
+				}
+				if shared[a.userID][b.userID] == nil {
+					shared[a.userID][b.userID] = map[string]bool{}
+				}
+				shared[a.userID][b.userID][a.multiplier] = true
+			}
+		}
+	}
+	for userID, others := range shared {
+		linked := 0
+		for _, multipliers := range others {
+			if len(multipliers) >= RISK_CLUSTER_FLIGHTS {
+				linked++
+			}
+		}
+		if linked >= RISK_CLUSTER_SIZE-1 {
+			flag(userID, 40, fmt.Sprintf("cashes out within %dms of %d other accounts at %d or more multipliers", RISK_CASHOUT_GAP, linked, RISK_CLUSTER_FLIGHTS))
+			timed[userID] = true
+		}
+	}
+
+	org := &aviator.OrgRisk{ID: orgID, OrgID: orgID, Players: int64(len(patterns)), DateUpdated: now.Unix()}
+	flaggedBets := int64(0)
+	for userID, risk := range risks {
+		risk.Bets = patterns[userID].bets
+		risk.Action = riskAction(risk.Score, timed[userID])
+		risk.DateUpdated = now.Unix()
+		if risk.Action != RISK_NONE {
+			org.Flagged++
+			flaggedBets += risk.Bets
+		}
+	}
+	if len(bets) > 0 {
+		org.Score = math.Round(float64(flaggedBets)/float64(len(bets))*10000) / 100
+	}
+	return org, risks, nil
+}
+
+// saveRisk writes a score under its id, replacing the one stored before.
+func (server *Server) saveRisk(collection, id string, risk any) error {
+	if _, err := server.db.InsertOne(collection, risk); err == nil || !mongo.IsDuplicateKeyError(err) {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(server.db.UpdateOne(collection, bson.M{"_id": id}, bson.M{"$set": risk}))
+}
+
+// saveOrgRisk stores the new scores and clears the players that were flagged
+// before but no longer are.
+func (server *Server) saveOrgRisk(org *aviator.OrgRisk, risks map[string]*aviator.PlayerRisk) error {
+	previous := []*aviator.PlayerRisk{}
+	if err := server.db.Find(PLAYER_RISK_COLLECTION, bson.M{"orgId": org.OrgID, "score": bson.M{"$gt": 0}}, &previous); err != nil {
+		return errors.WithStack(err)
+	}
+	for _, risk := range previous {
+		if _, ok := risks[risk.UserID]; !ok {
+			update := bson.M{"$set": bson.M{"score": 0, "reasons": []string{}, "action": RISK_NONE, "dateUpdated": org.DateUpdated}}
+			if err := server.db.UpdateOne(PLAYER_RISK_COLLECTION, bson.M{"_id": risk.ID}, update); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	for _, risk := range risks {
+		if err := server.saveRisk(PLAYER_RISK_COLLECTION, risk.ID, risk); err != nil {
+			return err
+		}
+	}
+	return server.saveRisk(ORG_RISK_COLLECTION, org.ID, org)
+}
+
+func (server *Server) runRiskScans() {
+	for range time.NewTicker(RISK_SCAN_EVERY).C {
+		clients, err := server.settingsStore.ListSettings(context.Background(), bson.M{})
+		if err != nil {
+			server.log.Err(err).Msg("failed to read clients for risk scan")
+			continue
+		}
+		for _, client := range clients {
+			if !server.ownsRounds(client.OrgID) {
+				continue
+			}
+			org, risks, err := server.scoreOrgRisk(client.OrgID, time.Now())
+			if err != nil {
+				server.log.Err(err).Msgf("failed to score risk for org %s", client.OrgID)
+				continue
+			}
+			if err := server.saveOrgRisk(org, risks); err != nil {
+				server.log.Err(err).Msgf("failed to save risk for org %s", client.OrgID)
+			}
+		}
+	}
+}
+
+// checkPlayerRisk blocks flagged players or lets them place one bet per
+// throttle interval, depending on their score.
+func (server *Server) checkPlayerRisk(ctx context.Context, orgID, userID string) error {
+	risk := &aviator.PlayerRisk{}
+	if err := server.db.FindOne(PLAYER_RISK_COLLECTION, bson.M{"_id": playerRiskID(orgID, userID)}, risk); errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	} else if err != nil {
+		return utils.NewServiceError(http.StatusServiceUnavailable, "failed to check account, try again").WithInternal(err)
+	}
+	switch risk.Action {
+	case RISK_BLOCK:
+		return utils.NewServiceError(http.StatusForbidden, "betting is suspended on this account, contact support")
+	case RISK_THROTTLE:
+		throttleKey := riskThrottleRedisKey(orgID, userID)
+		if placed, wait, err := server.limitStore.Claim(ctx, throttleKey, RISK_THROTTLE_INTERVAL); err == nil && !placed {
+			return rateLimitedError("PlacePlaneBet", max(wait.Round(time.Second), time.Second))
+		}
+	}
+	return nil
+}
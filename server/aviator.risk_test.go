@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/thedivinez/go-libs/services/aviator"
+)
+
+func TestRiskBlocksOnlyTimedCashouts(t *testing.T) {
+	h := newHarness(t)
+	now := time.Now()
+	bet := func(userID string, round int, multiplier float64, at, offset int64) {
+		stake := int64(500)
+		payout := payoutMinor(stake, multiplier)
+		placed := &aviator.PlaneBet{
+			BetId: fmt.Sprintf("%s-%d", userID, round), OrgID: testOrg, UserID: userID, FlightID: fmt.Sprint(round), Account: "live",
+			StakeMoney: money(stake, "USD"), PayoutMoney: money(payout, "USD"), CashedOutAt: at, TickOffset: offset, DateCreated: now.Unix(),
+		}
+		if _, err := h.server.db.InsertOne(BETS_COLLECTION, placed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for round := range RISK_MIN_BETS {
+		start := now.UnixMilli() + int64(round)*60_000
+		// players with the same stake and auto cashout target, cashing out with
+		// the jitter of their connections
+		for idx, userID := range []string{"auto-1", "auto-2", "auto-3"} {
+			offset := int64((round*37 + idx*53) % 100)
+			bet(userID, round, 2, start+2_000+offset, offset)
+		}
+		// bots cashing out together at a different multiplier every round
+		for idx, userID := range []string{"bot-1", "bot-2", "bot-3"} {
+			bet(userID, round, 1.5+float64(round)/10, start+3_000+int64(round)*100+int64(idx), 7)
+		}
+	}
+	_, risks, err := h.server.scoreOrgRisk(testOrg, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range []string{"auto-1", "auto-2", "auto-3"} {
+		if risk := risks[userID]; risk != nil && risk.Action != RISK_NONE {
+			t.Fatalf("%s plays a common strategy and should not be acted on, got %v", userID, risk)
+		}
+	}
+	for _, userID := range []string{"bot-1", "bot-2", "bot-3"} {
+		if risk := risks[userID]; risk == nil || risk.Action != RISK_BLOCK {
+			t.Fatalf("%s should be blocked, got %v", userID, risk)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"iter"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// roundScheduler drives the rounds of every org from one timer wheel. A round
+// runs while it holds a turn and gives it back whenever it waits, so no more
+// than the number of workers run at once and due rounds get a turn in the
+// order they became due.
+type roundScheduler struct {
+	sync.Mutex
+	clock Clock
+	slots [][]*roundTimer
+	last  time.Time
+	// ready holds the due rounds waiting for a turn
+	ready chan *roundTimer
+	turns chan struct{}
+}
+
+type roundTimer struct {
+	orgID string
+	due   time.Time
+	wake  chan time.Time
+}
+
+func newRoundScheduler(clock Clock, workers int) *roundScheduler {
+	return &roundScheduler{
+		clock: clock,
+		last:  clock.Now(),
+		slots: make([][]*roundTimer, SCHEDULER_SLOTS),
+		ready: make(chan *roundTimer, SCHEDULER_QUEUE),
+		turns: make(chan struct{}, max(workers, 1)),
+	}
+}
+
+// schedulerWorkers reads SCHEDULER_WORKERS, the number of rounds that can run
+// at the same time.
+func (server *Server) schedulerWorkers() int {
+	if workers, err := strconv.Atoi(server.config.SchedulerWorkers); err == nil && workers > 0 {
+		return workers
+	}
+	return SCHEDULER_WORKERS
+}
+
+func (scheduler *roundScheduler) slot(at time.Time) int {
+	return int(at.UnixNano() / int64(SCHEDULER_RESOLUTION) % SCHEDULER_SLOTS)
+}
+
+func (scheduler *roundScheduler) add(timer *roundTimer) {
+	scheduler.Lock()
+	if timer.due.After(scheduler.last) {
+		idx := scheduler.slot(timer.due)
+		scheduler.slots[idx] = append(scheduler.slots[idx], timer)
+		scheduler.Unlock()
+		return
+	}
+	scheduler.Unlock()
+	scheduler.ready <- timer
+	schedulerBacklog.Set(float64(len(scheduler.ready)))
+}
+
+// advance moves the wheel to now and queues the timers that are due, earliest
+// first. Timers a full turn of the wheel away stay in their slot.
+func (scheduler *roundScheduler) advance(now time.Time) {
+	scheduler.Lock()
+	due := []*roundTimer{}
+	first, last := scheduler.last.UnixNano()/int64(SCHEDULER_RESOLUTION), now.UnixNano()/int64(SCHEDULER_RESOLUTION)
+	if last-first >= SCHEDULER_SLOTS {
+		first = last - SCHEDULER_SLOTS + 1
+	}
+	for tick := first; tick <= last; tick++ {
+		idx := int(tick % SCHEDULER_SLOTS)
+		scheduler.slots[idx] = slices.DeleteFunc(scheduler.slots[idx], func(timer *roundTimer) bool {
+			if timer.due.After(now) {
+				return false
+			}
+			due = append(due, timer)
+			return true
+		})
+	}
+	scheduler.last = now
+	scheduler.Unlock()
+	slices.SortStableFunc(due, func(a, b *roundTimer) int { return a.due.Compare(b.due) })
+	for _, timer := range due {
+		scheduler.ready <- timer
+	}
+	schedulerBacklog.Set(float64(len(scheduler.ready)))
+}
+
+// run turns the wheel and hands out the turns.
+func (scheduler *roundScheduler) run() {
+	go func() {
+		ticker := scheduler.clock.NewTicker(SCHEDULER_RESOLUTION)
+		defer ticker.Stop()
+		for now := range ticker.C() {
+			scheduler.advance(now)
+		}
+	}()
+	for timer := range scheduler.ready {
+		scheduler.turns <- struct{}{}
+		schedulerBacklog.Set(float64(len(scheduler.ready)))
+		tickLag.WithLabelValues(timer.orgID).Observe(max(scheduler.clock.Now().Sub(timer.due), 0).Seconds())
+		timer.wake <- timer.due
+	}
+}
+
+func (scheduler *roundScheduler) wait(orgID string, due time.Time) time.Time {
+	timer := &roundTimer{orgID: orgID, due: due, wake: make(chan time.Time, 1)}
+	scheduler.add(timer)
+	return <-timer.wake
+}
+
+// start waits for the org's first turn.
+func (scheduler *roundScheduler) start(orgID string) {
+	scheduler.wait(orgID, scheduler.clock.Now())
+}
+
+// stop gives up the org's turn for good.
+func (scheduler *roundScheduler) stop() {
+	<-scheduler.turns
+}
+
+// sleepUntil gives up the org's turn until due and returns the time it was
+// due once the org has a turn again.
+func (scheduler *roundScheduler) sleepUntil(orgID string, due time.Time) time.Time {
+	<-scheduler.turns
+	return scheduler.wait(orgID, due)
+}
+
+func (scheduler *roundScheduler) sleep(orgID string, duration time.Duration) time.Time {
+	return scheduler.sleepUntil(orgID, scheduler.clock.Now().Add(duration))
+}
+
+// ticks yields every interval until the caller stops ranging. Like a ticker it
+// skips the ticks the round was too late for.
+func (scheduler *roundScheduler) ticks(orgID string, interval time.Duration) iter.Seq[time.Time] {
+	return func(yield func(time.Time) bool) {
+		next := scheduler.clock.Now().Add(interval)
+		for yield(scheduler.sleepUntil(orgID, next)) {
+			for now := scheduler.clock.Now(); !next.After(now); {
+				next = next.Add(interval)
+			}
+		}
+	}
+}
+
+// countdown yields the time left every second until the duration has passed,
+// starting with the whole duration and ending with zero.
+func (server *Server) countdown(orgID string, duration time.Duration) iter.Seq[time.Duration] {
+	return func(yield func(time.Duration) bool) {
+		end := server.clock.Now().Add(duration)
+		if !yield(duration) {
+			return
+		}
+		for tick := range server.rounds.ticks(orgID, time.Second) {
+			if left := max(end.Sub(tick).Round(time.Second), 0); !yield(left) || left == 0 {
+				return
+			}
+		}
+	}
+}
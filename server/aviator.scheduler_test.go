@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerBoundsAndSharesTurns(t *testing.T) {
+	const orgs, workers, rounds = 2000, 8, 5
+	clock := newManualClock()
+	scheduler := newRoundScheduler(clock, workers)
+	go scheduler.run()
+
+	running, busiest := atomic.Int64{}, atomic.Int64{}
+	ticked := make([]atomic.Int64, orgs)
+	done := sync.WaitGroup{}
+	for org := range orgs {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			orgID := fmt.Sprintf("org-%d", org)
+			scheduler.start(orgID)
+			defer scheduler.stop()
+			for range scheduler.ticks(orgID, FLIGHT_TICK_INTERVAL) {
+				now := running.Add(1)
+				for seen := busiest.Load(); now > seen && !busiest.CompareAndSwap(seen, now); seen = busiest.Load() {
+				}
+				time.Sleep(time.Microsecond)
+				running.Add(-1)
+				if ticked[org].Add(1) == rounds {
+					break
+				}
+			}
+		}()
+	}
+
+	parked := func() int {
+		scheduler.Lock()
+		defer scheduler.Unlock()
+		timers := 0
+		for _, slot := range scheduler.slots {
+			timers += len(slot)
+		}
+		return timers
+	}
+	waitFor := func(what string, ready func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); !ready(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	for tick := range rounds {
+		waitFor("every org to wait for its next tick", func() bool {
+			for org := range ticked {
+				if ticked[org].Load() < int64(tick) {
+					return false
+				}
+			}
+			return parked() == orgs
+		})
+		// every org gets its turn before any org gets another one
+		for org := range ticked {
+			if got := ticked[org].Load(); got != int64(tick) {
+				t.Fatalf("org %d ran %d ticks after %d intervals", org, got, tick)
+			}
+		}
+		clock.Advance(FLIGHT_TICK_INTERVAL)
+	}
+	finished := make(chan struct{})
+	go func() { done.Wait(); close(finished) }()
+	waitFor("every org to finish", func() bool {
+		select {
+		case <-finished:
+			return true
+		default:
+			return false
+		}
+	})
+	if got := busiest.Load(); got > workers {
+		t.Fatalf("%d rounds ran at once with %d workers", got, workers)
+	}
+}
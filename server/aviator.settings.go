@@ -0,0 +1,355 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/thedivinez/go-libs/services/aviator"
+	"github.com/thedivinez/go-libs/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+type editableSetting struct {
+	key   string
+	field protoreflect.Name
+}
+
+// editableSettings are the settings an admin can change, keyed by their json and
+// bson name. The org and the license are managed by Subscribe only, the pools
+// move with the rounds and are only adjusted through AdjustTreasury.
+var editableSettings = []editableSetting{
+	{"financed", "Financed"},
+	{"minDemoStake", "MinDemoStake"},
+	{"maxDemoStake", "MaxDemoStake"},
+	{"minTotalBets", "MinTotalBets"},
+	{"maxTotalBets", "MaxTotalBets"},
+	{"autoExplodeAfter", "AutoExplodeAfter"},
+	{"minDemoRiskAmount", "MinDemoRiskAmount"},
+	{"maxDemoRiskAmount", "MaxDemoRiskAmount"},
+	{"minRiskPercentage", "MinRiskPercentage"},
+	{"maxRiskPercentage", "MaxRiskPercentage"},
+	{"maxMultiplierShift", "MaxMultiplierShift"},
+	{"baseCurrency", "BaseCurrency"},
+	{"currencies", "Currencies"},
+	{"stakeLimits", "StakeLimits"},
+	{"exchangeRates", "ExchangeRates"},
+	{"jackpot", "Jackpot"},
+	{"cashback", "Cashback"},
+	{"rateLimits", "RateLimits"},
+}
+
+// settingValue returns a setting as it is stored, lists and maps are read from
+// the struct since their reflected values cannot be encoded.
+func settingValue(settings *aviator.PlaneSettings, setting editableSetting) any {
+	switch setting.key {
+	case "currencies":
+		return settings.Currencies
+	case "stakeLimits":
+		return settings.StakeLimits
+	case "exchangeRates":
+		return settings.ExchangeRates
+	case "jackpot":
+		return settings.Jackpot
+	case "cashback":
+		return settings.Cashback
+	case "rateLimits":
+		return settings.RateLimits
+	}
+	message := settings.ProtoReflect()
+	return message.Get(message.Descriptor().Fields().ByName(setting.field)).Interface()
+}
+
+func displaySetting(value any) string {
+	switch value.(type) {
+	case string, float64, int64, bool:
+		return fmt.Sprint(value)
+	}
+	if encoded, err := json.Marshal(value); err == nil {
+		return string(encoded)
+	}
+	return fmt.Sprint(value)
+}
+
+func findEditableSetting(key string) (editableSetting, bool) {
+	idx := slices.IndexFunc(editableSettings, func(setting editableSetting) bool { return setting.key == key })
+	if idx < 0 {
+		return editableSetting{}, false
+	}
+	return editableSettings[idx], true
+}
+
+func validatePlaneSettings(settings *aviator.PlaneSettings, base string) []*errdetails.BadRequest_FieldViolation {
+	violations := []*errdetails.BadRequest_FieldViolation{}
+	invalid := func(field, description string) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: field, Description: description})
+	}
+	message := settings.ProtoReflect()
+	for _, setting := range editableSettings {
+		switch value := message.Get(message.Descriptor().Fields().ByName(setting.field)).Interface().(type) {
+		case float64:
+			if value < 0 {
+				invalid(setting.key, "must not be negative")
+			}
+		case int64:
+			if value < 0 {
+				invalid(setting.key, "must not be negative")
+			}
+		}
+	}
+	if settings.MinDemoStake > settings.MaxDemoStake {
+		invalid("minDemoStake", "must not exceed maxDemoStake")
+	}
+	if settings.MinTotalBets > settings.MaxTotalBets {
+		invalid("minTotalBets", "must not exceed maxTotalBets")
+	}
+	if settings.MinDemoRiskAmount > settings.MaxDemoRiskAmount {
+		invalid("minDemoRiskAmount", "must not exceed maxDemoRiskAmount")
+	}
+	if settings.MinRiskPercentage > settings.MaxRiskPercentage {
+		invalid("minRiskPercentage", "must not exceed maxRiskPercentage")
+	}
+	if settings.MaxTotalBets == 0 {
+		invalid("maxTotalBets", "must be greater than zero")
+	}
+	if settings.MaxMultiplierShift < 0.01 {
+		invalid("maxMultiplierShift", "must be at least 0.01")
+	}
+	if settings.BaseCurrency != "" && len(settings.Currencies) > 0 && !slices.Contains(settings.Currencies, settings.BaseCurrency) {
+		invalid("currencies", "must include the base currency")
+	}
+	// every currency a bet may be placed in needs a rate to the base currency,
+	// which is the service's own when the org has not set one
+	for _, currency := range settings.Currencies {
+		if currency != base && settings.ExchangeRates[currency] <= 0 {
+			invalid("exchangeRates", fmt.Sprintf("needs a positive rate for %s", currency))
+		}
+	}
+	for currency, rate := range settings.ExchangeRates {
+		if rate <= 0 {
+			invalid("exchangeRates", fmt.Sprintf("rate for %s must be positive", currency))
+		}
+	}
+	if jackpot := settings.Jackpot; jackpot != nil {
+		if jackpot.ContributionPercentage < 0 || jackpot.ContributionPercentage > 100 {
+			invalid("jackpot.contributionPercentage", "must be between 0 and 100")
+		}
+		if jackpot.SeedAmount < 0 {
+			invalid("jackpot.seedAmount", "must not be negative")
+		}
+		if jackpot.DrawChance < 0 || jackpot.DrawChance > 1 {
+			invalid("jackpot.drawChance", "must be between 0 and 1")
+		}
+		if jackpot.TriggerMultiplier != 0 && jackpot.TriggerMultiplier < 1 {
+			invalid("jackpot.triggerMultiplier", "must be at least 1")
+		}
+	}
+	if cashback := settings.Cashback; cashback != nil {
+		if cashback.Percentage < 0 || cashback.Percentage > 100 {
+			invalid("cashback.percentage", "must be between 0 and 100")
+		}
+		if cashback.PeriodDays < 0 {
+			invalid("cashback.periodDays", "must not be negative")
+		}
+		if cashback.MinLoss < 0 {
+			invalid("cashback.minLoss", "must not be negative")
+		}
+	}
+	for method, limit := range settings.RateLimits {
+		if _, ok := rateLimitedMethods[method]; !ok {
+			invalid("rateLimits", fmt.Sprintf("%s is not a rate limited rpc", method))
+		} else if limit.Capacity < 0 || limit.RefillPerSecond < 0 || limit.OrgCapacity < 0 || limit.OrgRefillPerSecond < 0 {
+			invalid("rateLimits", fmt.Sprintf("budget for %s must not be negative", method))
+		} else if (limit.Capacity > 0) != (limit.RefillPerSecond > 0) || (limit.OrgCapacity > 0) != (limit.OrgRefillPerSecond > 0) {
+			invalid("rateLimits", fmt.Sprintf("budget for %s needs both a capacity and a refill rate", method))
+		}
+	}
+	for currency, limits := range settings.StakeLimits {
+		if limits.MinStake < 0 || limits.MaxStake < 0 {
+			invalid("stakeLimits", fmt.Sprintf("limits for %s must not be negative", currency))
+		} else if limits.MaxStake > 0 && limits.MinStake > limits.MaxStake {
+			invalid("stakeLimits", fmt.Sprintf("minimum stake for %s must not exceed its maximum", currency))
+		}
+	}
+	return violations
+}
+
+func invalidSettingsError(violations []*errdetails.BadRequest_FieldViolation) error {
+	invalid := status.New(codes.InvalidArgument, "invalid plane settings")
+	if detailed, err := invalid.WithDetails(&errdetails.BadRequest{FieldViolations: violations}); err == nil {
+		return detailed.Err()
+	}
+	return invalid.Err()
+}
+
+func (server *Server) recordSettingsChange(orgID string, version int64, changedBy string, changes []*aviator.SettingsFieldChange) {
+	change := &aviator.SettingsChange{
+		OrgID:       orgID,
+		Version:     version,
+		Changes:     changes,
+		ChangedBy:   changedBy,
+		DateCreated: time.Now().Unix(),
+		ID:          primitive.NewObjectID().Hex(),
+	}
+	if _, err := server.db.InsertOne(SETTINGS_HISTORY_COLLECTION, change); err != nil {
+		server.log.Err(err).Msgf("failed to record settings change for org %s", orgID)
+	}
+}
+
+func settingsVersionFilter(orgID string, version int64) bson.M {
+	if version == 0 {
+		// settings created before versioning have no version field
+		return bson.M{"orgId": orgID, "version": bson.M{"$in": []any{int64(0), nil}}}
+	}
+	return bson.M{"orgId": orgID, "version": version}
+}
+
+// updatePlaneSettings applies the fields named in the update mask to the version
+// of the settings the caller last read. Fields are set explicitly so they can be
+// set to zero. Without a mask only the fields the request carries are changed.
+func (server *Server) updatePlaneSettings(ctx context.Context, req *aviator.PlaneSettings) (*aviator.PlaneSettings, error) {
+	caller, err := adminFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	current, err := server.settingsStore.GetSettings(ctx, req.OrgID)
+	if err != nil {
+		return nil, utils.NewServiceError(http.StatusNotFound, "plane settings not found").WithInternal(err)
+	}
+	if current.Version != req.Version {
+		return nil, utils.NewServiceError(http.StatusConflict, "settings have changed since they were read, reload and try again")
+	}
+
+	mask := req.UpdateMask
+	if len(mask) == 0 {
+		fields := req.ProtoReflect()
+		for _, setting := range editableSettings {
+			if fields.Has(fields.Descriptor().Fields().ByName(setting.field)) {
+				mask = append(mask, setting.key)
+			}
+		}
+	}
+	if len(mask) == 0 {
+		return nil, invalidSettingsError([]*errdetails.BadRequest_FieldViolation{{Field: "updateMask", Description: "names no setting to change"}})
+	}
+	updated := proto.Clone(current).(*aviator.PlaneSettings)
+	to := updated.ProtoReflect()
+	set, changes := bson.M{}, []*aviator.SettingsFieldChange{}
+	violations := []*errdetails.BadRequest_FieldViolation{}
+	for _, key := range mask {
+		setting, ok := findEditableSetting(key)
+		if !ok {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: key, Description: "is not an editable setting"})
+			continue
+		}
+		field := to.Descriptor().Fields().ByName(setting.field)
+		if req.ProtoReflect().Has(field) {
+			to.Set(field, req.ProtoReflect().Get(field))
+		} else {
+			// empty lists and maps are read only views that cannot be set
+			to.Clear(field)
+		}
+		value := settingValue(req, setting)
+		set[setting.key] = value
+		if previous := displaySetting(settingValue(current, setting)); previous != displaySetting(value) {
+			changes = append(changes, &aviator.SettingsFieldChange{Field: setting.key, From: previous, To: displaySetting(value)})
+		}
+	}
+	violations = append(violations, validatePlaneSettings(updated, server.baseCurrency(updated))...)
+	if len(violations) > 0 {
+		return nil, invalidSettingsError(violations)
+	}
+	if len(changes) == 0 {
+		return current, nil
+	}
+
+	revision := primitive.NewObjectID().Hex()
+	set["revision"] = revision
+	set["version"] = current.Version + 1
+	if err := server.settingsStore.UpdateSettings(ctx, settingsVersionFilter(req.OrgID, req.Version), bson.M{"$set": set}); err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to update plane settings").WithInternal(err)
+	}
+	// only the writer whose revision landed won the race for this version
+	if written, err := server.settingsStore.GetRevision(ctx, req.OrgID); err != nil || written != revision {
+		return nil, utils.NewServiceError(http.StatusConflict, "settings have changed since they were read, reload and try again")
+	}
+	server.recordSettingsChange(req.OrgID, current.Version+1, caller.Name(), changes)
+
+	settings, err := server.settingsStore.GetSettings(ctx, req.OrgID)
+	if err != nil {
+		return nil, utils.NewServiceError(http.StatusNotFound, "plane settings not found").WithInternal(err)
+	}
+	return settings, nil
+}
+
+// adjustTreasury tops up or draws from the pools of a currency. The amounts are
+// added with $inc so the movements of running rounds are kept, and a draw only
+// lands when the pool holds enough.
+func (server *Server) adjustTreasury(ctx context.Context, req *aviator.AdjustTreasuryRequest) (*aviator.Treasury, error) {
+	caller, err := adminFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := server.settingsStore.GetSettings(ctx, req.OrgID)
+	if err != nil {
+		return nil, utils.NewServiceError(http.StatusNotFound, "plane settings not found").WithInternal(err)
+	}
+	if req.Currency == "" {
+		req.Currency = server.baseCurrency(settings)
+	}
+	if req.Currency != server.baseCurrency(settings) && !slices.Contains(settings.Currencies, req.Currency) {
+		return nil, utils.NewServiceError(http.StatusBadRequest, fmt.Sprintf("%s is not a currency of this org", req.Currency))
+	}
+	amounts := map[string]int64{}
+	filter := bson.M{"orgId": req.OrgID}
+	for field, amount := range map[string]int64{"amountToRisk": req.AmountToRisk, "reservedBalance": req.ReservedBalance} {
+		if amount == 0 {
+			continue
+		}
+		amounts[field] = amount
+		if amount < 0 {
+			filter[fmt.Sprintf("treasuries.%s.%s", req.Currency, field)] = bson.M{"$gte": -amount}
+		}
+	}
+	if len(amounts) == 0 {
+		return nil, utils.NewServiceError(http.StatusBadRequest, "nothing to adjust")
+	}
+	update := server.treasuryUpdate(settings, req.Currency, "$inc", amounts)
+	revision := primitive.NewObjectID().Hex()
+	update["$inc"].(bson.M)["version"] = int64(1)
+	update["$set"] = bson.M{"revision": revision}
+	if err := server.settingsStore.UpdateSettings(ctx, filter, update); err != nil {
+		return nil, utils.NewServiceError(http.StatusInternalServerError, "failed to adjust treasury").WithInternal(err)
+	}
+	if written, err := server.settingsStore.GetRevision(ctx, req.OrgID); err != nil || written != revision {
+		return nil, utils.NewServiceError(http.StatusConflict, "the treasury does not hold enough to draw that amount")
+	}
+	adjusted, err := server.settingsStore.GetSettings(ctx, req.OrgID)
+	if err != nil {
+		return nil, utils.NewServiceError(http.StatusNotFound, "plane settings not found").WithInternal(err)
+	}
+	amountToRisk, reservedBalance := server.treasuryBalances(adjusted, req.Currency)
+	balances := map[string]int64{"amountToRisk": amountToRisk, "reservedBalance": reservedBalance}
+	changes := []*aviator.SettingsFieldChange{}
+	for _, field := range []string{"amountToRisk", "reservedBalance"} {
+		if amount, ok := amounts[field]; ok {
+			changes = append(changes, &aviator.SettingsFieldChange{
+				Field: fmt.Sprintf("treasuries.%s.%s", req.Currency, field),
+				From:  fmt.Sprint(balances[field] - amount),
+				To:    fmt.Sprint(balances[field]),
+			})
+		}
+	}
+	server.recordSettingsChange(req.OrgID, adjusted.Version, caller.Name(), changes)
+	server.observeTreasury(req.OrgID)
+	return &aviator.Treasury{AmountToRisk: amountToRisk, ReservedBalance: reservedBalance}, nil
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/thedivinez/go-libs/services/aviator"
+)
+
+func TestSettingsUpdateLeavesTheTreasury(t *testing.T) {
+	h := newHarness(t)
+	current, err := h.server.settingsStore.GetSettings(context.Background(), testOrg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a partial update only changes what it carries
+	updated, err := h.server.updatePlaneSettings(asPlatform(), &aviator.PlaneSettings{OrgID: testOrg, Version: current.Version, MaxMultiplierShift: 0.7})
+	if err != nil {
+		t.Fatalf("failed to update settings: %v", err)
+	}
+	if updated.MaxMultiplierShift != 0.7 || updated.MinTotalBets != 100 || updated.Treasuries["USD"].AmountToRisk != h.treasury().AmountToRisk {
+		t.Fatalf("only maxMultiplierShift should change, got %v", updated)
+	}
+	if _, err := h.server.updatePlaneSettings(asPlatform(), &aviator.PlaneSettings{OrgID: testOrg, Version: updated.Version, UpdateMask: []string{"amountToRisk"}}); err == nil {
+		t.Fatal("the pools should not be editable as settings")
+	}
+	before := h.treasury().AmountToRisk
+	treasury, err := h.server.adjustTreasury(asPlatform(), &aviator.AdjustTreasuryRequest{OrgID: testOrg, Currency: "USD", AmountToRisk: 500})
+	if err != nil || treasury.AmountToRisk != before+500 {
+		t.Fatalf("a top up should add to the pool, got %v (%v)", treasury, err)
+	}
+	if _, err := h.server.adjustTreasury(asPlatform(), &aviator.AdjustTreasuryRequest{OrgID: testOrg, Currency: "USD", ReservedBalance: -1}); err == nil {
+		t.Fatal("a draw should not take the reserve below zero")
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"github.com/thedivinez/go-libs/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	errFlightNotFound = errors.New("no flight found")
+	errBetNotFound    = errors.New("bet not found")
+	errFlightEnded    = errors.New("flight has ended")
+	errBetFlying      = errors.New("bet is flying")
+)
+
+// DocumentStore is the part of storage.Database the service uses, so the
+// documents can also be kept in memory.
+type DocumentStore interface {
+	Find(collection string, filter any, out any) error
+	FindOne(collection string, filter any, out any) error
+	GetPage(collection string, filter any, page string, limit int64, sort int, out any) error
+	InsertOne(collection string, document any) (any, error)
+	InsertMany(collection string, documents any) error
+	UpdateOne(collection string, filter any, update any) error
+}
+
+// FlightStore keeps the flights that have not exploded yet.
+type FlightStore interface {
+	SaveFlight(ctx context.Context, flight *aviator.Flight) error
+	GetFlight(ctx context.Context, orgID, flightID string) (*aviator.Flight, error)
+	// FindFlight returns the flight of an org that is in the given state.
+	FindFlight(ctx context.Context, orgID, state string) (*aviator.Flight, error)
+	// SetFlightFields writes single fields of a flight, keyed by their json name.
+	SetFlightFields(ctx context.Context, orgID, flightID string, fields map[string]any) error
+	// AddProfitBlown records a live cashout against the round and the pool of its currency.
+	AddProfitBlown(ctx context.Context, orgID, flightID, currency string, basePayout *aviator.Money, payout int64) error
+	DeleteFlight(ctx context.Context, orgID, flightID string) error
+	// ClaimRounds takes the lease on the rounds of an org for the owner, or
+	// extends it when the owner holds it already. It fails while another owner
+	// holds it.
+	ClaimRounds(ctx context.Context, orgID, owner string, ttl time.Duration) (bool, error)
+	// RoundsOwner reads who holds the lease on the rounds of an org, it is
+	// empty while nobody does.
+	RoundsOwner(ctx context.Context, orgID string) (string, error)
+}
+
+// BetStore keeps a copy of the bet books, written behind them, so a restart can
+// pick the rounds up again.
+type BetStore interface {
+	OpenBook(ctx context.Context, orgID, flightID string) error
+	AddBet(ctx context.Context, bet *aviator.PlaneBet) error
+	GetBets(ctx context.Context, orgID, flightID string) ([]aviator.PlaneBet, error)
+	// TakeBet removes a bet of the user from the flight and returns it, only one
+	// caller can take the same bet. Closed bets are left alone when openOnly is set.
+	TakeBet(ctx context.Context, orgID, flightID, betID, userID string, openOnly bool) (*aviator.PlaneBet, error)
+	// GetUserBets returns the bets the user has riding on any flight of the org.
+	GetUserBets(ctx context.Context, orgID, userID string) ([]*aviator.PlaneBet, error)
+	DeleteBook(ctx context.Context, orgID, flightID string) error
+}
+
+// SettingsStore keeps the plane settings and treasury of every org.
+type SettingsStore interface {
+	GetSettings(ctx context.Context, orgID string) (*aviator.PlaneSettings, error)
+	ListSettings(ctx context.Context, filter bson.M) ([]*aviator.PlaneSettings, error)
+	CreateSettings(ctx context.Context, settings *aviator.PlaneSettings) error
+	UpdateSettings(ctx context.Context, filter bson.M, update bson.M) error
+	// GetRevision reads the token of the last write to the settings of an org.
+	GetRevision(ctx context.Context, orgID string) (string, error)
+}
+
+// HistoryStore keeps the last results of an org and archives finished rounds.
+type HistoryStore interface {
+	PushResult(ctx context.Context, orgID, result string) error
+	GetResults(ctx context.Context, orgID string) ([]string, error)
+	ArchiveFlight(ctx context.Context, flight *aviator.Flight, bets []aviator.PlaneBet) error
+	ArchiveBet(ctx context.Context, bet *aviator.PlaneBet) error
+}
+
+// tokenBucket is a rate limit budget kept under key, refilled by refill tokens
+// per second up to capacity.
+type tokenBucket struct {
+	key      string
+	capacity int64
+	refill   float64
+}
+
+// LimitStore keeps the short lived state that holds callers back.
+type LimitStore interface {
+	// TakeToken takes a token from every bucket when all of them have one, so a
+	// call refused by one budget does not use up the others. It returns how long
+	// to wait when it refused.
+	TakeToken(ctx context.Context, buckets []tokenBucket) (bool, time.Duration, error)
+	// Claim holds key for ttl when nobody holds it, and otherwise returns how
+	// long the current claim has left.
+	Claim(ctx context.Context, key string, ttl time.Duration) (bool, time.Duration, error)
+	// StartSession starts a session that ends after idle unless one is running,
+	// and returns when the running session started.
+	StartSession(ctx context.Context, key string, idle time.Duration) (time.Time, error)
+	// ExtendSession pushes the end of a running session idle into the future.
+	ExtendSession(ctx context.Context, key string, idle time.Duration) error
+	Ping(ctx context.Context) error
+}
+
+// ChatStore keeps the last messages and the moderation of every org's chat.
+type ChatStore interface {
+	PushMessage(ctx context.Context, message *aviator.ChatMessage) error
+	// GetMessages returns the last messages of the org, oldest first.
+	GetMessages(ctx context.Context, orgID string, limit int64) ([]*aviator.ChatMessage, error)
+	// Restrict mutes or bans a player, a zero duration lasts until it is lifted.
+	Restrict(ctx context.Context, orgID, userID, restriction string, duration time.Duration) error
+	Lift(ctx context.Context, orgID, userID, restriction string) error
+	// Restriction tells whether the player is under the restriction and how
+	// long it has left, zero for one without end.
+	Restriction(ctx context.Context, orgID, userID, restriction string) (bool, time.Duration, error)
+}
+
+// openStorage connects the stores to redis and mongo, or keeps everything in
+// memory when STORAGE is memory.
+func (server *Server) openStorage() error {
+	if strings.EqualFold(server.config.Storage, STORAGE_MEMORY) {
+		server.db = newMemoryDocuments()
+		server.flightStore = newMemoryFlightStore()
+		server.betStore = newMemoryBetStore()
+		server.historyStore = newMemoryHistoryStore(server.db)
+		server.chatStore = newMemoryChatStore()
+		server.limitStore = newMemoryLimitStore()
+	} else {
+		server.redis = storage.NewRedisCache(server.config.Redis, 1)
+		server.db = storage.NewMongoStorage(server.config.MongoDBConfig)
+		server.flightStore = &redisFlightStore{redis: server.redis}
+		server.betStore = &redisBetStore{redis: server.redis}
+		server.historyStore = &redisHistoryStore{redis: server.redis, documentArchive: documentArchive{db: server.db}}
+		server.chatStore = &redisChatStore{redis: server.redis}
+		server.limitStore = &redisLimitStore{redis: server.redis}
+		if err := rebuildIndexes(context.Background(), server.redis); err != nil {
+			return err
+		}
+	}
+	server.settingsStore = &documentSettingsStore{db: server.db}
+	return nil
+}
@@ -0,0 +1,870 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/protobuf/proto"
+)
+
+type memoryFlightStore struct {
+	sync.Mutex
+	flights map[string]*aviator.Flight
+	// states indexes the flight id of every org by state
+	states map[string]map[string]string
+	leases map[string]roundLease
+}
+
+type roundLease struct {
+	owner string
+	ends  time.Time
+}
+
+func newMemoryFlightStore() *memoryFlightStore {
+	return &memoryFlightStore{flights: map[string]*aviator.Flight{}, states: map[string]map[string]string{}, leases: map[string]roundLease{}}
+}
+
+// index points a state of the org's flight index at the flight and drops the
+// states it was in before. An empty state only drops them.
+func (store *memoryFlightStore) index(orgID, flightID, state string) {
+	states, ok := store.states[orgID]
+	if !ok {
+		states = map[string]string{}
+		store.states[orgID] = states
+	}
+	maps.DeleteFunc(states, func(_, indexed string) bool { return indexed == flightID })
+	if state != "" {
+		states[state] = flightID
+	}
+}
+
+func (store *memoryFlightStore) SaveFlight(ctx context.Context, flight *aviator.Flight) error {
+	store.Lock()
+	defer store.Unlock()
+	store.flights[planeflightRedisKey(flight.OrgID, flight.ID)] = proto.Clone(flight).(*aviator.Flight)
+	store.index(flight.OrgID, flight.ID, flight.State)
+	return nil
+}
+
+func (store *memoryFlightStore) GetFlight(ctx context.Context, orgID, flightID string) (*aviator.Flight, error) {
+	store.Lock()
+	defer store.Unlock()
+	if flight, ok := store.flights[planeflightRedisKey(orgID, flightID)]; ok {
+		return proto.Clone(flight).(*aviator.Flight), nil
+	}
+	return nil, errors.WithStack(errFlightNotFound)
+}
+
+func (store *memoryFlightStore) FindFlight(ctx context.Context, orgID, state string) (*aviator.Flight, error) {
+	store.Lock()
+	defer store.Unlock()
+	if flight, ok := store.flights[planeflightRedisKey(orgID, store.states[orgID][state])]; ok {
+		return proto.Clone(flight).(*aviator.Flight), nil
+	}
+	return nil, errors.WithStack(errFlightNotFound)
+}
+
+// SetFlightFields goes through json so the fields are named the same way the
+// redis store names them.
+func (store *memoryFlightStore) SetFlightFields(ctx context.Context, orgID, flightID string, fields map[string]any) error {
+	store.Lock()
+	defer store.Unlock()
+	flightKey := planeflightRedisKey(orgID, flightID)
+	flight, ok := store.flights[flightKey]
+	if !ok {
+		return errors.WithStack(errFlightNotFound)
+	}
+	encoded, err := json.Marshal(flight)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	document := map[string]any{}
+	if err := json.Unmarshal(encoded, &document); err != nil {
+		return errors.WithStack(err)
+	}
+	for field, value := range fields {
+		document[field] = value
+	}
+	if encoded, err = json.Marshal(document); err != nil {
+		return errors.WithStack(err)
+	}
+	updated := &aviator.Flight{}
+	if err := json.Unmarshal(encoded, updated); err != nil {
+		return errors.WithStack(err)
+	}
+	store.flights[flightKey] = updated
+	if _, ok := fields["state"]; ok {
+		store.index(orgID, flightID, updated.State)
+	}
+	return nil
+}
+
+func (store *memoryFlightStore) AddProfitBlown(ctx context.Context, orgID, flightID, currency string, basePayout *aviator.Money, payout int64) error {
+	store.Lock()
+	defer store.Unlock()
+	flight, ok := store.flights[planeflightRedisKey(orgID, flightID)]
+	if !ok {
+		return errors.WithStack(errFlightNotFound)
+	}
+	flight.ProfitBlown += fromMinor(basePayout.Minor, basePayout.Currency)
+	if flight.ProfitBlownMoney != nil {
+		flight.ProfitBlownMoney.Minor += basePayout.Minor
+	}
+	if exposure, ok := flight.Exposures[currency]; ok {
+		exposure.ProfitBlown += payout
+	}
+	return nil
+}
+
+func (store *memoryFlightStore) DeleteFlight(ctx context.Context, orgID, flightID string) error {
+	store.Lock()
+	defer store.Unlock()
+	delete(store.flights, planeflightRedisKey(orgID, flightID))
+	store.index(orgID, flightID, "")
+	return nil
+}
+
+func (store *memoryFlightStore) ClaimRounds(ctx context.Context, orgID, owner string, ttl time.Duration) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+	now := time.Now()
+	if lease, ok := store.leases[orgID]; ok && lease.owner != owner && lease.ends.After(now) {
+		return false, nil
+	}
+	store.leases[orgID] = roundLease{owner: owner, ends: now.Add(ttl)}
+	return true, nil
+}
+
+func (store *memoryFlightStore) RoundsOwner(ctx context.Context, orgID string) (string, error) {
+	store.Lock()
+	defer store.Unlock()
+	if lease, ok := store.leases[orgID]; ok && lease.ends.After(time.Now()) {
+		return lease.owner, nil
+	}
+	return "", nil
+}
+
+type memoryBetStore struct {
+	sync.Mutex
+	books map[string][]*aviator.PlaneBet
+	// active indexes the flight of every bet a user has riding, by bet id
+	active map[string]map[string]string
+}
+
+func newMemoryBetStore() *memoryBetStore {
+	return &memoryBetStore{books: map[string][]*aviator.PlaneBet{}, active: map[string]map[string]string{}}
+}
+
+func (store *memoryBetStore) OpenBook(ctx context.Context, orgID, flightID string) error {
+	store.Lock()
+	defer store.Unlock()
+	store.books[flightBetsRedisKey(orgID, flightID)] = []*aviator.PlaneBet{}
+	return nil
+}
+
+func (store *memoryBetStore) AddBet(ctx context.Context, bet *aviator.PlaneBet) error {
+	store.Lock()
+	defer store.Unlock()
+	bookKey := flightBetsRedisKey(bet.OrgID, bet.FlightID)
+	book, ok := store.books[bookKey]
+	if !ok {
+		return errors.Errorf("flight %s has no bet book", bet.FlightID)
+	}
+	store.books[bookKey] = append(book, proto.Clone(bet).(*aviator.PlaneBet))
+	activeKey := activeBetsRedisKey(bet.OrgID, bet.UserID)
+	if _, ok := store.active[activeKey]; !ok {
+		store.active[activeKey] = map[string]string{}
+	}
+	store.active[activeKey][bet.BetId] = bet.FlightID
+	return nil
+}
+
+func (store *memoryBetStore) GetBets(ctx context.Context, orgID, flightID string) ([]aviator.PlaneBet, error) {
+	store.Lock()
+	defer store.Unlock()
+	book, ok := store.books[flightBetsRedisKey(orgID, flightID)]
+	if !ok {
+		return nil, errors.Errorf("flight %s has no bet book", flightID)
+	}
+	bets := make([]aviator.PlaneBet, 0, len(book))
+	for _, bet := range book {
+		bets = append(bets, aviator.PlaneBet{})
+		proto.Merge(&bets[len(bets)-1], bet)
+	}
+	return bets, nil
+}
+
+func (store *memoryBetStore) TakeBet(ctx context.Context, orgID, flightID, betID, userID string, openOnly bool) (*aviator.PlaneBet, error) {
+	store.Lock()
+	defer store.Unlock()
+	bookKey := flightBetsRedisKey(orgID, flightID)
+	book := store.books[bookKey]
+	idx := slices.IndexFunc(book, func(bet *aviator.PlaneBet) bool {
+		return bet.BetId == betID && bet.UserID == userID && (!openOnly || bet.Status != "closed")
+	})
+	if idx < 0 {
+		return nil, errors.WithStack(errBetNotFound)
+	}
+	bet := book[idx]
+	store.books[bookKey] = slices.Delete(book, idx, idx+1)
+	delete(store.active[activeBetsRedisKey(orgID, userID)], betID)
+	return bet, nil
+}
+
+func (store *memoryBetStore) GetUserBets(ctx context.Context, orgID, userID string) ([]*aviator.PlaneBet, error) {
+	store.Lock()
+	defer store.Unlock()
+	bets := []*aviator.PlaneBet{}
+	for betID, flightID := range store.active[activeBetsRedisKey(orgID, userID)] {
+		for _, bet := range store.books[flightBetsRedisKey(orgID, flightID)] {
+			if bet.BetId == betID {
+				bets = append(bets, proto.Clone(bet).(*aviator.PlaneBet))
+			}
+		}
+	}
+	return bets, nil
+}
+
+func (store *memoryBetStore) DeleteBook(ctx context.Context, orgID, flightID string) error {
+	store.Lock()
+	defer store.Unlock()
+	bookKey := flightBetsRedisKey(orgID, flightID)
+	for _, bet := range store.books[bookKey] {
+		delete(store.active[activeBetsRedisKey(orgID, bet.UserID)], bet.BetId)
+	}
+	delete(store.books, bookKey)
+	return nil
+}
+
+type memoryHistoryStore struct {
+	documentArchive
+	sync.Mutex
+	results map[string][]string
+}
+
+func newMemoryHistoryStore(db DocumentStore) *memoryHistoryStore {
+	return &memoryHistoryStore{documentArchive: documentArchive{db: db}, results: map[string][]string{}}
+}
+
+func (store *memoryHistoryStore) PushResult(ctx context.Context, orgID, result string) error {
+	store.Lock()
+	defer store.Unlock()
+	results := append([]string{result}, store.results[orgID]...)
+	store.results[orgID] = results[:min(len(results), PLANE_HISTORY_SIZE)]
+	return nil
+}
+
+func (store *memoryHistoryStore) GetResults(ctx context.Context, orgID string) ([]string, error) {
+	store.Lock()
+	defer store.Unlock()
+	return slices.Clone(store.results[orgID]), nil
+}
+
+// memoryDocuments is a DocumentStore that keeps every collection in memory. It
+// understands the filter and update operators this service uses, documents go
+// through bson so they are stored and matched under their bson names.
+type memoryDocuments struct {
+	sync.Mutex
+	collections map[string][]bson.M
+}
+
+func newMemoryDocuments() *memoryDocuments {
+	return &memoryDocuments{collections: map[string][]bson.M{}}
+}
+
+func toDocument(value any) (bson.M, error) {
+	encoded, err := bson.Marshal(value)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	document := bson.M{}
+	return document, errors.WithStack(bson.Unmarshal(encoded, &document))
+}
+
+func fromDocument(document bson.M, out any) error {
+	encoded, err := bson.Marshal(document)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(bson.Unmarshal(encoded, out))
+}
+
+func (db *memoryDocuments) find(collection string, filter any) ([]bson.M, error) {
+	conditions, err := toDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+	found := []bson.M{}
+	for _, document := range db.collections[collection] {
+		if matchDocument(document, conditions) {
+			found = append(found, document)
+		}
+	}
+	return found, nil
+}
+
+func (db *memoryDocuments) Find(collection string, filter any, out any) error {
+	db.Lock()
+	defer db.Unlock()
+	found, err := db.find(collection, filter)
+	if err != nil {
+		return err
+	}
+	return decodeDocuments(found, out)
+}
+
+func (db *memoryDocuments) FindOne(collection string, filter any, out any) error {
+	db.Lock()
+	defer db.Unlock()
+	found, err := db.find(collection, filter)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return errors.WithStack(mongo.ErrNoDocuments)
+	}
+	return fromDocument(found[0], out)
+}
+
+// GetPage sorts on _id and reads page numbers starting at 1.
+func (db *memoryDocuments) GetPage(collection string, filter any, page string, limit int64, sort int, out any) error {
+	db.Lock()
+	defer db.Unlock()
+	found, err := db.find(collection, filter)
+	if err != nil {
+		return err
+	}
+	slices.SortStableFunc(found, func(a, b bson.M) int {
+		order, _ := compareValues(a["_id"], b["_id"])
+		return order * sort
+	})
+	if limit > 0 {
+		number, err := strconv.ParseInt(page, 10, 64)
+		if err != nil || number < 1 {
+			number = 1
+		}
+		start := min((number-1)*limit, int64(len(found)))
+		found = found[start:min(start+limit, int64(len(found)))]
+	}
+	return decodeDocuments(found, out)
+}
+
+func (db *memoryDocuments) insert(collection string, value any) (any, error) {
+	document, err := toDocument(value)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := document["_id"]; !ok {
+		document["_id"] = primitive.NewObjectID()
+	}
+	for _, existing := range db.collections[collection] {
+		if equalValues(existing["_id"], document["_id"]) {
+			return nil, mongo.WriteException{WriteErrors: []mongo.WriteError{{
+				Code:    11000,
+				Message: fmt.Sprintf("E11000 duplicate key error collection: %s dup key: { _id: %v }", collection, document["_id"]),
+			}}}
+		}
+	}
+	db.collections[collection] = append(db.collections[collection], document)
+	return document["_id"], nil
+}
+
+func (db *memoryDocuments) InsertOne(collection string, document any) (any, error) {
+	db.Lock()
+	defer db.Unlock()
+	return db.insert(collection, document)
+}
+
+func (db *memoryDocuments) InsertMany(collection string, documents any) error {
+	db.Lock()
+	defer db.Unlock()
+	values := reflect.ValueOf(documents)
+	if values.Kind() != reflect.Slice {
+		return errors.Errorf("documents must be a slice, got %T", documents)
+	}
+	for idx := 0; idx < values.Len(); idx++ {
+		if _, err := db.insert(collection, values.Index(idx).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *memoryDocuments) UpdateOne(collection string, filter any, update any) error {
+	db.Lock()
+	defer db.Unlock()
+	found, err := db.find(collection, filter)
+	if err != nil || len(found) == 0 {
+		return err
+	}
+	operations, err := toDocument(update)
+	if err != nil {
+		return err
+	}
+	return applyUpdate(found[0], operations)
+}
+
+func decodeDocuments(documents []bson.M, out any) error {
+	slice := reflect.ValueOf(out).Elem()
+	itemType := slice.Type().Elem()
+	items := reflect.MakeSlice(slice.Type(), 0, len(documents))
+	for _, document := range documents {
+		item := reflect.New(itemType)
+		if itemType.Kind() == reflect.Pointer {
+			item = reflect.New(itemType.Elem())
+		}
+		if err := fromDocument(document, item.Interface()); err != nil {
+			return err
+		}
+		if itemType.Kind() != reflect.Pointer {
+			item = item.Elem()
+		}
+		items = reflect.Append(items, item)
+	}
+	slice.Set(items)
+	return nil
+}
+
+// lookupPath follows a dotted path through documents and array indexes.
+func lookupPath(document bson.M, path string) (any, bool) {
+	var value any = document
+	for _, key := range strings.Split(path, ".") {
+		switch current := value.(type) {
+		case bson.M:
+			next, ok := current[key]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case bson.A:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(current) {
+				return nil, false
+			}
+			value = current[idx]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// setPath writes a value at a dotted path, creating the documents on the way.
+func setPath(document bson.M, path string, value any) error {
+	keys := strings.Split(path, ".")
+	var current any = document
+	for idx, key := range keys {
+		last := idx == len(keys)-1
+		switch container := current.(type) {
+		case bson.M:
+			if last {
+				container[key] = value
+				return nil
+			}
+			if _, ok := container[key]; !ok {
+				container[key] = bson.M{}
+			}
+			current = container[key]
+		case bson.A:
+			position, err := strconv.Atoi(key)
+			if err != nil || position < 0 || position >= len(container) {
+				return errors.Errorf("cannot write %s, %s is not an index of the array", path, key)
+			}
+			if last {
+				container[position] = value
+				return nil
+			}
+			current = container[position]
+		default:
+			return errors.Errorf("cannot write %s through a %T", path, current)
+		}
+	}
+	return nil
+}
+
+func toFloat(value any) (float64, bool) {
+	switch number := value.(type) {
+	case int32:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case int:
+		return float64(number), true
+	case float64:
+		return number, true
+	case primitive.DateTime:
+		return float64(number), true
+	}
+	return 0, false
+}
+
+// compareValues orders two numbers or two strings, the second result is false
+// when they cannot be ordered.
+func compareValues(a, b any) (int, bool) {
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	if x, ok := a.(primitive.ObjectID); ok {
+		a = x.Hex()
+	}
+	if y, ok := b.(primitive.ObjectID); ok {
+		b = y.Hex()
+	}
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	}
+	return 0, false
+}
+
+func equalValues(a, b any) bool {
+	if order, ok := compareValues(a, b); ok {
+		return order == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// equalsField matches like mongo does: nil matches a missing field and an
+// array matches when one of its items does.
+func equalsField(value any, exists bool, expected any) bool {
+	if !exists {
+		return expected == nil
+	}
+	if items, ok := value.(bson.A); ok {
+		if slices.ContainsFunc(items, func(item any) bool { return equalValues(item, expected) }) {
+			return true
+		}
+	}
+	return equalValues(value, expected)
+}
+
+func matchDocument(document bson.M, filter bson.M) bool {
+	for key, condition := range filter {
+		switch key {
+		case "$or":
+			alternatives, _ := condition.(bson.A)
+			if !slices.ContainsFunc(alternatives, func(alternative any) bool {
+				sub, ok := alternative.(bson.M)
+				return ok && matchDocument(document, sub)
+			}) {
+				return false
+			}
+		case "$and":
+			required, _ := condition.(bson.A)
+			for _, sub := range required {
+				if sub, ok := sub.(bson.M); !ok || !matchDocument(document, sub) {
+					return false
+				}
+			}
+		default:
+			value, exists := lookupPath(document, key)
+			if !matchCondition(value, exists, condition) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func matchCondition(value any, exists bool, condition any) bool {
+	operators, ok := condition.(bson.M)
+	if !ok || len(operators) == 0 {
+		return equalsField(value, exists, condition)
+	}
+	for operator, operand := range operators {
+		if !strings.HasPrefix(operator, "$") {
+			return equalsField(value, exists, condition)
+		}
+		order, ordered := compareValues(value, operand)
+		switch operator {
+		case "$exists":
+			if want, _ := operand.(bool); want != exists {
+				return false
+			}
+		case "$ne":
+			if equalsField(value, exists, operand) {
+				return false
+			}
+		case "$in", "$nin":
+			candidates, _ := operand.(bson.A)
+			in := slices.ContainsFunc(candidates, func(candidate any) bool { return equalsField(value, exists, candidate) })
+			if in != (operator == "$in") {
+				return false
+			}
+		case "$gt":
+			if !exists || !ordered || order <= 0 {
+				return false
+			}
+		case "$gte":
+			if !exists || !ordered || order < 0 {
+				return false
+			}
+		case "$lt":
+			if !exists || !ordered || order >= 0 {
+				return false
+			}
+		case "$lte":
+			if !exists || !ordered || order > 0 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func applyUpdate(document bson.M, update bson.M) error {
+	for operator, fields := range update {
+		fields, ok := fields.(bson.M)
+		if !ok {
+			return errors.Errorf("%s takes a document", operator)
+		}
+		for path, operand := range fields {
+			current, exists := lookupPath(document, path)
+			switch operator {
+			case "$set":
+				if err := setPath(document, path, operand); err != nil {
+					return err
+				}
+			case "$unset":
+				keys := strings.Split(path, ".")
+				if parent, ok := lookupPath(document, strings.Join(keys[:len(keys)-1], ".")); ok && len(keys) > 1 {
+					if parent, ok := parent.(bson.M); ok {
+						delete(parent, keys[len(keys)-1])
+					}
+				} else {
+					delete(document, path)
+				}
+			case "$inc":
+				if err := setPath(document, path, addNumbers(current, operand)); err != nil {
+					return err
+				}
+			case "$push", "$addToSet":
+				items, _ := current.(bson.A)
+				if exists && current != nil && items == nil {
+					return errors.Errorf("cannot %s to %s, it is not an array", operator, path)
+				}
+				additions := bson.A{operand}
+				if each, ok := operand.(bson.M); ok && each["$each"] != nil {
+					additions, _ = each["$each"].(bson.A)
+				}
+				for _, addition := range additions {
+					if operator == "$push" || !slices.ContainsFunc(items, func(item any) bool { return equalValues(item, addition) }) {
+						items = append(items, addition)
+					}
+				}
+				if err := setPath(document, path, items); err != nil {
+					return err
+				}
+			default:
+				return errors.Errorf("update operator %s is not supported in memory", operator)
+			}
+		}
+	}
+	return nil
+}
+
+// addNumbers keeps integers as integers, like $inc does.
+func addNumbers(current, delta any) any {
+	toInt := func(value any) (int64, bool) {
+		switch number := value.(type) {
+		case nil:
+			return 0, true
+		case int32:
+			return int64(number), true
+		case int64:
+			return number, true
+		case int:
+			return int64(number), true
+		}
+		return 0, false
+	}
+	if x, ok := toInt(current); ok {
+		if y, ok := toInt(delta); ok {
+			return x + y
+		}
+	}
+	x, _ := toFloat(current)
+	y, _ := toFloat(delta)
+	return x + y
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type memoryLimitStore struct {
+	sync.Mutex
+	buckets map[string]memoryBucket
+	// claims and sessions keep the time they run out
+	claims   map[string]time.Time
+	sessions map[string]memorySession
+}
+
+type memorySession struct {
+	started time.Time
+	ends    time.Time
+}
+
+func newMemoryLimitStore() *memoryLimitStore {
+	return &memoryLimitStore{buckets: map[string]memoryBucket{}, claims: map[string]time.Time{}, sessions: map[string]memorySession{}}
+}
+
+func (store *memoryLimitStore) TakeToken(ctx context.Context, buckets []tokenBucket) (bool, time.Duration, error) {
+	store.Lock()
+	defer store.Unlock()
+	now := time.Now()
+	allowed, wait := true, time.Duration(0)
+	tokens := make([]float64, len(buckets))
+	for idx, bucket := range buckets {
+		capacity := float64(bucket.capacity)
+		state, ok := store.buckets[bucket.key]
+		if !ok {
+			state = memoryBucket{tokens: capacity, updated: now}
+		}
+		tokens[idx] = min(capacity, state.tokens+now.Sub(state.updated).Seconds()*bucket.refill)
+		if tokens[idx] < 1 {
+			allowed = false
+			if bucket.refill > 0 {
+				wait = max(wait, time.Duration(math.Ceil((1-tokens[idx])/bucket.refill*1000))*time.Millisecond)
+			}
+		}
+	}
+	for idx, bucket := range buckets {
+		if allowed {
+			tokens[idx]--
+		}
+		store.buckets[bucket.key] = memoryBucket{tokens: tokens[idx], updated: now}
+	}
+	return allowed, wait, nil
+}
+
+func (store *memoryLimitStore) Claim(ctx context.Context, key string, ttl time.Duration) (bool, time.Duration, error) {
+	store.Lock()
+	defer store.Unlock()
+	now := time.Now()
+	if ends, ok := store.claims[key]; ok && ends.After(now) {
+		return false, ends.Sub(now), nil
+	}
+	// nonces are claimed once and never again, drop the ones that ran out
+	maps.DeleteFunc(store.claims, func(_ string, ends time.Time) bool { return !ends.After(now) })
+	store.claims[key] = now.Add(ttl)
+	return true, 0, nil
+}
+
+func (store *memoryLimitStore) StartSession(ctx context.Context, key string, idle time.Duration) (time.Time, error) {
+	store.Lock()
+	defer store.Unlock()
+	now := time.Now().Truncate(time.Second)
+	session, ok := store.sessions[key]
+	if !ok || !session.ends.After(now) {
+		session = memorySession{started: now, ends: now.Add(idle)}
+		store.sessions[key] = session
+	}
+	return session.started, nil
+}
+
+func (store *memoryLimitStore) ExtendSession(ctx context.Context, key string, idle time.Duration) error {
+	store.Lock()
+	defer store.Unlock()
+	if session, ok := store.sessions[key]; ok {
+		session.ends = time.Now().Add(idle)
+		store.sessions[key] = session
+	}
+	return nil
+}
+
+func (store *memoryLimitStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+type memoryChatStore struct {
+	sync.Mutex
+	messages map[string][]*aviator.ChatMessage
+	// restrictions keep the time they run out, zero for none
+	restrictions map[string]time.Time
+}
+
+func newMemoryChatStore() *memoryChatStore {
+	return &memoryChatStore{messages: map[string][]*aviator.ChatMessage{}, restrictions: map[string]time.Time{}}
+}
+
+func (store *memoryChatStore) PushMessage(ctx context.Context, message *aviator.ChatMessage) error {
+	store.Lock()
+	defer store.Unlock()
+	messages := append(store.messages[message.OrgID], proto.Clone(message).(*aviator.ChatMessage))
+	store.messages[message.OrgID] = messages[max(len(messages)-CHAT_HISTORY_SIZE, 0):]
+	return nil
+}
+
+func (store *memoryChatStore) GetMessages(ctx context.Context, orgID string, limit int64) ([]*aviator.ChatMessage, error) {
+	store.Lock()
+	defer store.Unlock()
+	messages := store.messages[orgID]
+	messages = messages[max(len(messages)-int(limit), 0):]
+	found := make([]*aviator.ChatMessage, 0, len(messages))
+	for _, message := range messages {
+		found = append(found, proto.Clone(message).(*aviator.ChatMessage))
+	}
+	return found, nil
+}
+
+func (store *memoryChatStore) Restrict(ctx context.Context, orgID, userID, restriction string, duration time.Duration) error {
+	store.Lock()
+	defer store.Unlock()
+	ends := time.Time{}
+	if duration > 0 {
+		ends = time.Now().Add(duration)
+	}
+	store.restrictions[chatRestrictionRedisKey(orgID, userID, restriction)] = ends
+	return nil
+}
+
+func (store *memoryChatStore) Lift(ctx context.Context, orgID, userID, restriction string) error {
+	store.Lock()
+	defer store.Unlock()
+	delete(store.restrictions, chatRestrictionRedisKey(orgID, userID, restriction))
+	return nil
+}
+
+func (store *memoryChatStore) Restriction(ctx context.Context, orgID, userID, restriction string) (bool, time.Duration, error) {
+	store.Lock()
+	defer store.Unlock()
+	key := chatRestrictionRedisKey(orgID, userID, restriction)
+	ends, ok := store.restrictions[key]
+	switch {
+	case !ok:
+		return false, 0, nil
+	case ends.IsZero():
+		return true, 0, nil
+	case !ends.After(time.Now()):
+		delete(store.restrictions, key)
+		return false, 0, nil
+	}
+	return true, time.Until(ends), nil
+}
@@ -0,0 +1,475 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"github.com/thedivinez/go-libs/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func planeHistoryRedisKey(orgId string) string {
+	return fmt.Sprintf("%s-plane-history", orgId)
+}
+
+func flightIndexRedisKey(orgId string) string {
+	return fmt.Sprintf("%s-plane:flights", orgId)
+}
+
+func roundsOwnerRedisKey(orgId string) string {
+	return fmt.Sprintf("%s-plane:owner", orgId)
+}
+
+func activeBetsRedisKey(orgId, userId string) string {
+	return fmt.Sprintf("%s-flight:active-bets-%s", orgId, userId)
+}
+
+func activeBetMember(flightId, betId string) string {
+	return fmt.Sprintf("%s:%s", flightId, betId)
+}
+
+// indexFlightScript points a state of the org's flight index at the flight and
+// drops the states it was in before. An empty state only drops them.
+var indexFlightScript = redis.NewScript(`
+local index = redis.call("HGETALL", KEYS[1])
+for i = 1, #index, 2 do
+	if index[i + 1] == ARGV[1] and index[i] ~= ARGV[2] then
+		redis.call("HDEL", KEYS[1], index[i])
+	end
+end
+if ARGV[2] ~= "" then
+	redis.call("HSET", KEYS[1], ARGV[2], ARGV[1])
+end
+return 0
+`)
+
+// claimRoundsScript gives the rounds of an org to the owner unless another
+// owner holds them.
+var claimRoundsScript = redis.NewScript(`
+local owner = redis.call("GET", KEYS[1])
+if owner and owner ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+// rebuildIndexes indexes the flights and bets written before the indexes
+// existed. It scans once at boot so lookups never have to.
+func rebuildIndexes(ctx context.Context, cache *storage.RedisCache) error {
+	for iter := cache.Scan(ctx, 0, "*-plane:flight-*", 0); iter.Next(ctx); {
+		flight := aviator.Flight{}
+		if err := cache.Read(iter.Val(), "$", &flight); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := indexFlightScript.Run(ctx, cache.Client, []string{flightIndexRedisKey(flight.OrgID)}, flight.ID, flight.State).Err(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	for iter := cache.Scan(ctx, 0, "*-flight:bets-*", 0); iter.Next(ctx); {
+		bets := []aviator.PlaneBet{}
+		if err := cache.Read(iter.Val(), "$", &bets); err != nil {
+			return errors.WithStack(err)
+		}
+		for idx := range bets {
+			member := activeBetMember(bets[idx].FlightID, bets[idx].BetId)
+			if err := cache.Client.SAdd(ctx, activeBetsRedisKey(bets[idx].OrgID, bets[idx].UserID), member).Err(); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	return nil
+}
+
+type redisFlightStore struct {
+	redis *storage.RedisCache
+}
+
+func (store *redisFlightStore) SaveFlight(ctx context.Context, flight *aviator.Flight) error {
+	encoded, err := json.Marshal(flight)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	pipe := store.redis.Client.TxPipeline()
+	pipe.JSONSet(ctx, planeflightRedisKey(flight.OrgID, flight.ID), "$", encoded)
+	indexFlightScript.Eval(ctx, pipe, []string{flightIndexRedisKey(flight.OrgID)}, flight.ID, flight.State)
+	_, err = pipe.Exec(ctx)
+	return errors.WithStack(err)
+}
+
+func (store *redisFlightStore) GetFlight(ctx context.Context, orgID, flightID string) (*aviator.Flight, error) {
+	flight := aviator.Flight{}
+	if err := store.redis.Read(planeflightRedisKey(orgID, flightID), "$", &flight); err != nil {
+		return nil, err
+	}
+	return &flight, nil
+}
+
+func (store *redisFlightStore) FindFlight(ctx context.Context, orgID, state string) (*aviator.Flight, error) {
+	flightID, err := store.redis.Client.HGet(ctx, flightIndexRedisKey(orgID), state).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, errors.WithStack(errFlightNotFound)
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	flight, err := store.GetFlight(ctx, orgID, flightID)
+	if err != nil {
+		return nil, err
+	}
+	if flight.State != state {
+		return nil, errors.WithStack(errFlightNotFound)
+	}
+	return flight, nil
+}
+
+func (store *redisFlightStore) SetFlightFields(ctx context.Context, orgID, flightID string, fields map[string]any) error {
+	pipe := store.redis.Client.TxPipeline()
+	for field, value := range fields {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		pipe.JSONSet(ctx, planeflightRedisKey(orgID, flightID), "$."+field, encoded)
+	}
+	if state, ok := fields["state"].(string); ok {
+		indexFlightScript.Eval(ctx, pipe, []string{flightIndexRedisKey(orgID)}, flightID, state)
+	}
+	_, err := pipe.Exec(ctx)
+	return errors.WithStack(err)
+}
+
+func (store *redisFlightStore) AddProfitBlown(ctx context.Context, orgID, flightID, currency string, basePayout *aviator.Money, payout int64) error {
+	flightRedisKey := planeflightRedisKey(orgID, flightID)
+	pipe := store.redis.Client.TxPipeline()
+	pipe.JSONNumIncrBy(ctx, flightRedisKey, "$.profitBlown", fromMinor(basePayout.Minor, basePayout.Currency))
+	pipe.JSONNumIncrBy(ctx, flightRedisKey, "$.profitBlownMoney.minor", float64(basePayout.Minor))
+	pipe.JSONNumIncrBy(ctx, flightRedisKey, fmt.Sprintf("$.exposures.%s.profitBlown", currency), float64(payout))
+	_, err := pipe.Exec(ctx)
+	return errors.WithStack(err)
+}
+
+func (store *redisFlightStore) DeleteFlight(ctx context.Context, orgID, flightID string) error {
+	pipe := store.redis.Client.TxPipeline()
+	pipe.Del(ctx, planeflightRedisKey(orgID, flightID))
+	indexFlightScript.Eval(ctx, pipe, []string{flightIndexRedisKey(orgID)}, flightID, "")
+	_, err := pipe.Exec(ctx)
+	return errors.WithStack(err)
+}
+
+func (store *redisFlightStore) ClaimRounds(ctx context.Context, orgID, owner string, ttl time.Duration) (bool, error) {
+	claimed, err := claimRoundsScript.Run(ctx, store.redis.Client, []string{roundsOwnerRedisKey(orgID)}, owner, ttl.Milliseconds()).Int()
+	return claimed == 1, errors.WithStack(err)
+}
+
+func (store *redisFlightStore) RoundsOwner(ctx context.Context, orgID string) (string, error) {
+	owner, err := store.redis.Client.Get(ctx, roundsOwnerRedisKey(orgID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return owner, errors.WithStack(err)
+}
+
+type redisBetStore struct {
+	redis *storage.RedisCache
+}
+
+func (store *redisBetStore) OpenBook(ctx context.Context, orgID, flightID string) error {
+	return errors.WithStack(store.redis.Write(flightBetsRedisKey(orgID, flightID), "$", []aviator.PlaneBet{}))
+}
+
+func (store *redisBetStore) AddBet(ctx context.Context, bet *aviator.PlaneBet) error {
+	pipe := store.redis.Client.TxPipeline()
+	pipe.JSONArrAppend(ctx, flightBetsRedisKey(bet.OrgID, bet.FlightID), "$", bet)
+	pipe.SAdd(ctx, activeBetsRedisKey(bet.OrgID, bet.UserID), activeBetMember(bet.FlightID, bet.BetId))
+	_, err := pipe.Exec(ctx)
+	return errors.WithStack(err)
+}
+
+func (store *redisBetStore) GetBets(ctx context.Context, orgID, flightID string) ([]aviator.PlaneBet, error) {
+	bets := []aviator.PlaneBet{}
+	if err := store.redis.Read(flightBetsRedisKey(orgID, flightID), "$", &bets); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return bets, nil
+}
+
+func (store *redisBetStore) TakeBet(ctx context.Context, orgID, flightID, betID, userID string, openOnly bool) (*aviator.PlaneBet, error) {
+	condition := fmt.Sprintf("@.id=='%s' && @.flightId=='%s' && @.userId=='%s'", betID, flightID, userID)
+	if openOnly {
+		condition += " && @.status!='closed'"
+	}
+	path := fmt.Sprintf("$.[?(%s)]", condition)
+	betsRedisKey := flightBetsRedisKey(orgID, flightID)
+	bet := &aviator.PlaneBet{}
+	if err := store.redis.Read(betsRedisKey, path, bet); err != nil {
+		return nil, errors.WithStack(errBetNotFound)
+	}
+	pipe := store.redis.Client.TxPipeline()
+	deleted := pipe.JSONDel(ctx, betsRedisKey, path)
+	pipe.SRem(ctx, activeBetsRedisKey(orgID, userID), activeBetMember(flightID, betID))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// only the caller that deleted the bet owns it
+	if deleted.Val() == 0 {
+		return nil, errors.WithStack(errBetNotFound)
+	}
+	return bet, nil
+}
+
+func (store *redisBetStore) GetUserBets(ctx context.Context, orgID, userID string) ([]*aviator.PlaneBet, error) {
+	members, err := store.redis.Client.SMembers(ctx, activeBetsRedisKey(orgID, userID)).Result()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	flights := map[string]bool{}
+	for _, member := range members {
+		flightID, _, _ := strings.Cut(member, ":")
+		flights[flightID] = true
+	}
+	bets := []*aviator.PlaneBet{}
+	for flightID := range flights {
+		betsInOneFlight := []*aviator.PlaneBet{}
+		if err := store.redis.Read(flightBetsRedisKey(orgID, flightID), fmt.Sprintf("$.[?(@.userId=='%s')]", userID), &betsInOneFlight); err == nil {
+			bets = append(bets, betsInOneFlight...)
+		}
+	}
+	return bets, nil
+}
+
+func (store *redisBetStore) DeleteBook(ctx context.Context, orgID, flightID string) error {
+	betsRedisKey := flightBetsRedisKey(orgID, flightID)
+	bets, _ := store.GetBets(ctx, orgID, flightID)
+	pipe := store.redis.Client.TxPipeline()
+	pipe.Del(ctx, betsRedisKey)
+	for idx := range bets {
+		pipe.SRem(ctx, activeBetsRedisKey(orgID, bets[idx].UserID), activeBetMember(flightID, bets[idx].BetId))
+	}
+	_, err := pipe.Exec(ctx)
+	return errors.WithStack(err)
+}
+
+// documentSettingsStore keeps the settings in the clients collection of a
+// DocumentStore, which is mongo or memory.
+type documentSettingsStore struct {
+	db DocumentStore
+}
+
+func (store *documentSettingsStore) GetSettings(ctx context.Context, orgID string) (*aviator.PlaneSettings, error) {
+	settings := &aviator.PlaneSettings{}
+	if err := store.db.FindOne(CLIENTS_COLLECTION, bson.M{"orgId": orgID}, settings); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return settings, nil
+}
+
+func (store *documentSettingsStore) ListSettings(ctx context.Context, filter bson.M) ([]*aviator.PlaneSettings, error) {
+	clients := []*aviator.PlaneSettings{}
+	if err := store.db.Find(CLIENTS_COLLECTION, filter, &clients); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return clients, nil
+}
+
+func (store *documentSettingsStore) CreateSettings(ctx context.Context, settings *aviator.PlaneSettings) error {
+	_, err := store.db.InsertOne(CLIENTS_COLLECTION, settings)
+	return errors.WithStack(err)
+}
+
+func (store *documentSettingsStore) UpdateSettings(ctx context.Context, filter bson.M, update bson.M) error {
+	return errors.WithStack(store.db.UpdateOne(CLIENTS_COLLECTION, filter, update))
+}
+
+func (store *documentSettingsStore) GetRevision(ctx context.Context, orgID string) (string, error) {
+	written := struct {
+		Revision string `bson:"revision"`
+	}{}
+	if err := store.db.FindOne(CLIENTS_COLLECTION, bson.M{"orgId": orgID}, &written); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return written.Revision, nil
+}
+
+// documentArchive writes finished rounds to the flights and bets collections.
+type documentArchive struct {
+	db DocumentStore
+}
+
+func (archive documentArchive) ArchiveFlight(ctx context.Context, flight *aviator.Flight, bets []aviator.PlaneBet) error {
+	if _, err := archive.db.InsertOne(FLIGHTS_COLLECTION, flight); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(archive.db.InsertMany(BETS_COLLECTION, bets))
+}
+
+func (archive documentArchive) ArchiveBet(ctx context.Context, bet *aviator.PlaneBet) error {
+	_, err := archive.db.InsertOne(BETS_COLLECTION, bet)
+	return errors.WithStack(err)
+}
+
+type redisHistoryStore struct {
+	documentArchive
+	redis *storage.RedisCache
+}
+
+func (store *redisHistoryStore) PushResult(ctx context.Context, orgID, result string) error {
+	pipe := store.redis.Client.TxPipeline()
+	pipe.LPush(ctx, planeHistoryRedisKey(orgID), result)
+	pipe.LTrim(ctx, planeHistoryRedisKey(orgID), 0, PLANE_HISTORY_SIZE-1)
+	_, err := pipe.Exec(ctx)
+	return errors.WithStack(err)
+}
+
+func (store *redisHistoryStore) GetResults(ctx context.Context, orgID string) ([]string, error) {
+	results, err := store.redis.Client.LRange(ctx, planeHistoryRedisKey(orgID), 0, -1).Result()
+	return results, errors.WithStack(err)
+}
+
+// tokenBucketScript refills every bucket for the time since it was last used
+// and takes a token from each of them only when all of them have one, so a
+// call rejected by the user budget does not use up the org budget. It returns
+// whether the call is allowed and how many milliseconds to wait otherwise.
+var tokenBucketScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local allowed, wait = 1, 0
+local buckets = {}
+for i, key in ipairs(KEYS) do
+	local capacity = tonumber(ARGV[i * 2])
+	local refill = tonumber(ARGV[i * 2 + 1])
+	local state = redis.call("HMGET", key, "tokens", "updated")
+	local tokens = tonumber(state[1]) or capacity
+	local updated = tonumber(state[2]) or now
+	tokens = math.min(capacity, tokens + math.max(0, now - updated) / 1000 * refill)
+	if tokens < 1 then
+		allowed = 0
+		wait = math.max(wait, math.ceil((1 - tokens) / refill * 1000))
+	end
+	buckets[i] = {tokens, capacity, refill}
+end
+for i, key in ipairs(KEYS) do
+	local tokens = buckets[i][1]
+	if allowed == 1 then
+		tokens = tokens - 1
+	end
+	redis.call("HSET", key, "tokens", tostring(tokens), "updated", tostring(now))
+	redis.call("PEXPIRE", key, math.ceil(buckets[i][2] / buckets[i][3] * 1000) + 1000)
+end
+return {allowed, wait}
+`)
+
+type redisLimitStore struct {
+	redis *storage.RedisCache
+}
+
+func (store *redisLimitStore) TakeToken(ctx context.Context, buckets []tokenBucket) (bool, time.Duration, error) {
+	keys, args := []string{}, []any{time.Now().UnixMilli()}
+	for _, bucket := range buckets {
+		keys = append(keys, bucket.key)
+		args = append(args, bucket.capacity, bucket.refill)
+	}
+	result, err := tokenBucketScript.Run(ctx, store.redis.Client, keys, args...).Int64Slice()
+	if err != nil {
+		return false, 0, errors.WithStack(err)
+	}
+	if len(result) != 2 {
+		return false, 0, errors.Errorf("token bucket returned %d values", len(result))
+	}
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
+
+func (store *redisLimitStore) Claim(ctx context.Context, key string, ttl time.Duration) (bool, time.Duration, error) {
+	claimed, err := store.redis.Client.SetNX(ctx, key, time.Now().Unix(), ttl).Result()
+	if err != nil || claimed {
+		return claimed, 0, errors.WithStack(err)
+	}
+	left, err := store.redis.Client.PTTL(ctx, key).Result()
+	return false, max(left, 0), errors.WithStack(err)
+}
+
+func (store *redisLimitStore) StartSession(ctx context.Context, key string, idle time.Duration) (time.Time, error) {
+	if err := store.redis.Client.SetNX(ctx, key, time.Now().Unix(), idle).Err(); err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+	started, err := store.redis.Client.Get(ctx, key).Int64()
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+	return time.Unix(started, 0), nil
+}
+
+func (store *redisLimitStore) ExtendSession(ctx context.Context, key string, idle time.Duration) error {
+	return errors.WithStack(store.redis.Client.Expire(ctx, key, idle).Err())
+}
+
+func (store *redisLimitStore) Ping(ctx context.Context) error {
+	return errors.WithStack(store.redis.Client.Ping(ctx).Err())
+}
+
+type redisChatStore struct {
+	redis *storage.RedisCache
+}
+
+func chatRestrictionRedisKey(orgID, userID, restriction string) string {
+	if restriction == CHAT_BAN {
+		return chatBannedRedisKey(orgID, userID)
+	}
+	return chatMutedRedisKey(orgID, userID)
+}
+
+func (store *redisChatStore) PushMessage(ctx context.Context, message *aviator.ChatMessage) error {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	historyKey := chatHistoryRedisKey(message.OrgID)
+	pipe := store.redis.Client.TxPipeline()
+	pipe.RPush(ctx, historyKey, encoded)
+	pipe.LTrim(ctx, historyKey, -CHAT_HISTORY_SIZE, -1)
+	_, err = pipe.Exec(ctx)
+	return errors.WithStack(err)
+}
+
+func (store *redisChatStore) GetMessages(ctx context.Context, orgID string, limit int64) ([]*aviator.ChatMessage, error) {
+	encoded, err := store.redis.Client.LRange(ctx, chatHistoryRedisKey(orgID), -limit, -1).Result()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	messages := make([]*aviator.ChatMessage, 0, len(encoded))
+	for _, entry := range encoded {
+		message := &aviator.ChatMessage{}
+		if err := json.Unmarshal([]byte(entry), message); err != nil {
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func (store *redisChatStore) Restrict(ctx context.Context, orgID, userID, restriction string, duration time.Duration) error {
+	return errors.WithStack(store.redis.Client.Set(ctx, chatRestrictionRedisKey(orgID, userID, restriction), time.Now().Unix(), duration).Err())
+}
+
+func (store *redisChatStore) Lift(ctx context.Context, orgID, userID, restriction string) error {
+	return errors.WithStack(store.redis.Client.Del(ctx, chatRestrictionRedisKey(orgID, userID, restriction)).Err())
+}
+
+func (store *redisChatStore) Restriction(ctx context.Context, orgID, userID, restriction string) (bool, time.Duration, error) {
+	left, err := store.redis.Client.PTTL(ctx, chatRestrictionRedisKey(orgID, userID, restriction)).Result()
+	if err != nil {
+		return false, 0, errors.WithStack(err)
+	}
+	// redis answers -2 for a missing key and -1 for one without expiry
+	switch {
+	case left == -2:
+		return false, 0, nil
+	case left < 0:
+		return true, 0, nil
+	}
+	return true, left, nil
+}
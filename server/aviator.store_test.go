@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"github.com/thedivinez/go-libs/storage"
+)
+
+// cacheStores runs a check against the memory stores and the redis ones, the
+// latter on an embedded redis.
+func cacheStores(t *testing.T, check func(t *testing.T, limits LimitStore, chat ChatStore)) {
+	t.Run("memory", func(t *testing.T) {
+		check(t, newMemoryLimitStore(), newMemoryChatStore())
+	})
+	t.Run("redis", func(t *testing.T) {
+		embedded := miniredis.RunT(t)
+		cache := storage.NewRedisCache(embedded.Addr(), 1)
+		check(t, &redisLimitStore{redis: cache}, &redisChatStore{redis: cache})
+	})
+}
+
+func TestLimitStores(t *testing.T) {
+	cacheStores(t, func(t *testing.T, limits LimitStore, _ ChatStore) {
+		ctx := context.Background()
+		user, org := tokenBucket{"user", 2, 0.5}, tokenBucket{"org", 10, 1}
+		for idx := range 3 {
+			allowed, wait, err := limits.TakeToken(ctx, []tokenBucket{user, org})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed != (idx < 2) {
+				t.Fatalf("call %d allowed is %v", idx, allowed)
+			}
+			if !allowed && (wait <= 0 || wait > 2*time.Second) {
+				t.Fatalf("a refused call should wait up to 2s for a token, got %s", wait)
+			}
+		}
+		// the refused call left the org bucket alone
+		for range 8 {
+			if allowed, _, err := limits.TakeToken(ctx, []tokenBucket{org}); err != nil || !allowed {
+				t.Fatalf("the org bucket should have tokens left (%v)", err)
+			}
+		}
+
+		if claimed, _, err := limits.Claim(ctx, "nonce", time.Minute); err != nil || !claimed {
+			t.Fatalf("a fresh key should be claimed (%v)", err)
+		}
+		if claimed, left, err := limits.Claim(ctx, "nonce", time.Minute); err != nil || claimed || left <= 0 {
+			t.Fatalf("a held key should not be claimed again, got %v with %s left (%v)", claimed, left, err)
+		}
+
+		started, err := limits.StartSession(ctx, "session", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again, err := limits.StartSession(ctx, "session", time.Minute); err != nil || !again.Equal(started) {
+			t.Fatalf("a running session should keep its start, got %s and %s (%v)", started, again, err)
+		}
+	})
+}
+
+func TestChatStores(t *testing.T) {
+	cacheStores(t, func(t *testing.T, _ LimitStore, chat ChatStore) {
+		ctx := context.Background()
+		for _, text := range []string{"one", "two", "three"} {
+			if err := chat.PushMessage(ctx, &aviator.ChatMessage{OrgID: testOrg, Text: text}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		messages, err := chat.GetMessages(ctx, testOrg, 2)
+		if err != nil || len(messages) != 2 || messages[0].Text != "two" || messages[1].Text != "three" {
+			t.Fatalf("should get the last two messages oldest first, got %v (%v)", messages, err)
+		}
+
+		if err := chat.Restrict(ctx, testOrg, "ivan", CHAT_MUTE, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if err := chat.Restrict(ctx, testOrg, "ivan", CHAT_BAN, 0); err != nil {
+			t.Fatal(err)
+		}
+		if muted, left, err := chat.Restriction(ctx, testOrg, "ivan", CHAT_MUTE); err != nil || !muted || left <= 0 || left > time.Minute {
+			t.Fatalf("ivan should be muted for up to a minute, got %v for %s (%v)", muted, left, err)
+		}
+		if banned, left, err := chat.Restriction(ctx, testOrg, "ivan", CHAT_BAN); err != nil || !banned || left != 0 {
+			t.Fatalf("ivan should be banned without end, got %v for %s (%v)", banned, left, err)
+		}
+		if err := chat.Lift(ctx, testOrg, "ivan", CHAT_BAN); err != nil {
+			t.Fatal(err)
+		}
+		if banned, _, err := chat.Restriction(ctx, testOrg, "ivan", CHAT_BAN); err != nil || banned {
+			t.Fatalf("the ban should be lifted (%v)", err)
+		}
+	})
+}
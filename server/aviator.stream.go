@@ -0,0 +1,67 @@
+package server
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/thedivinez/go-libs/services/aviator"
+	"google.golang.org/protobuf/proto"
+)
+
+// flightStream is the state of an org's flight as its clients were last told.
+// Messages about it are numbered per org, a client that sees a gap in seq has
+// missed one and fetches the whole state again with GetFlightState.
+type flightStream struct {
+	seq   int64
+	state *aviator.FlightState
+}
+
+type streamRegistry struct {
+	sync.Mutex
+	orgs map[string]*flightStream
+}
+
+// nextFlightMessage numbers the state of an org's flight and returns the event
+// to send for it. The whole state goes out when the flight, its phase or its
+// leaderboard changed, otherwise only the multiplier and the new cashouts.
+func (server *Server) nextFlightMessage(orgID string, state *aviator.FlightState) (string, any) {
+	server.streams.Lock()
+	defer server.streams.Unlock()
+	if server.streams.orgs == nil {
+		server.streams.orgs = map[string]*flightStream{}
+	}
+	stream, ok := server.streams.orgs[orgID]
+	if !ok {
+		stream = &flightStream{}
+		server.streams.orgs[orgID] = stream
+	}
+	stream.seq++
+	state.Seq = stream.seq
+	last := stream.state
+	stream.state = state
+	if last == nil || last.ID != state.ID || last.State != state.State || last.TotalBets != state.TotalBets || !sameLeaderBoard(last.LeaderBoard, state.LeaderBoard) {
+		return "flight:state", state
+	}
+	delta := &aviator.FlightStateDelta{ID: state.ID, Seq: state.Seq, Multiplier: state.Multiplier}
+	for idx, entry := range state.LeaderBoard {
+		if entry.CashedOut && !last.LeaderBoard[idx].CashedOut {
+			delta.CashedOut = append(delta.CashedOut, entry)
+		}
+	}
+	return "flight:delta", delta
+}
+
+func sameLeaderBoard(a, b []*aviator.FlightLeaderBoard) bool {
+	return slices.EqualFunc(a, b, func(a, b *aviator.FlightLeaderBoard) bool { return a.Name == b.Name })
+}
+
+// flightState returns the last state sent about an org's flight.
+func (server *Server) flightState(orgID string) (*aviator.FlightState, bool) {
+	server.streams.Lock()
+	defer server.streams.Unlock()
+	stream, ok := server.streams.orgs[orgID]
+	if !ok || stream.state == nil {
+		return nil, false
+	}
+	return proto.Clone(stream.state).(*aviator.FlightState), true
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thedivinez/go-libs/services/aviator"
+	"github.com/thedivinez/go-libs/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var tournamentMetrics = []string{TOURNAMENT_METRIC_MULTIPLIER, TOURNAMENT_METRIC_WAGERED, TOURNAMENT_METRIC_PROFIT}
+
+func validateTournament(tournament *aviator.Tournament) error {
+	if strings.TrimSpace(tournament.Name) == "" {
+		return utils.NewServiceError(http.StatusBadRequest, "tournament name is required")
+	}
+	if !slices.Contains(tournamentMetrics, tournament.Metric) {
+		return utils.NewServiceError(http.StatusBadRequest, fmt.Sprintf("metric must be one of %s", strings.Join(tournamentMetrics, ", ")))
+	}
+	if tournament.EndsAt <= tournament.StartsAt || tournament.EndsAt <= time.Now().Unix() {
+		return utils.NewServiceError(http.StatusBadRequest, "tournament must end in the future and after it starts")
+	}
+	if tournament.MinStake < 0 || tournament.MaxPlayers < 0 {
+		return utils.NewServiceError(http.StatusBadRequest, "minimum stake and maximum players must not be negative")
+	}
+	for _, prize := range tournament.Prizes {
+		if prize.FromRank < 1 || prize.ToRank < prize.FromRank || prize.Amount <= 0 {
+			return utils.NewServiceError(http.StatusBadRequest, "prizes need a valid rank range and a positive amount")
+		}
+	}
+	return nil
+}
+
+func tournamentPrize(tournament *aviator.Tournament, rank int64) int64 {
+	for _, prize := range tournament.Prizes {
+		if rank >= prize.FromRank && rank <= prize.ToRank {
+			return prize.Amount
+		}
+	}
+	return 0
+}
+
+// tournamentStandings ranks the players on the live bets they placed in the
+// tournament currency during its window. Free bets and bets under the minimum
+// stake do not count.
+func (server *Server) tournamentStandings(tournament *aviator.Tournament) ([]*aviator.TournamentStanding, error) {
+	bets := []*aviator.PlaneBet{}
+	filter := bson.M{
+		"orgId":       tournament.OrgID,
+		"account":     "live",
+		"freeBetId":   bson.M{"$in": []any{"", nil}},
+		"dateCreated": bson.M{"$gte": tournament.StartsAt, "$lt": tournament.EndsAt},
+	}
+	if tournament.RegistrationRequired {
+		filter["userId"] = bson.M{"$in": tournament.Players}
+	}
+	if err := server.db.Find(BETS_COLLECTION, filter, &bets); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	settings := server.getPlaneSettings(tournament.OrgID)
+	scores := map[string]*aviator.TournamentStanding{}
+	for _, bet := range bets {
+		stake, payout := server.moneyMinor(bet.StakeMoney, bet.Stake), server.moneyMinor(bet.PayoutMoney, bet.Payout)
+		if server.betCurrency(settings, bet) != tournament.Currency || stake < tournament.MinStake || stake == 0 {
+			continue
+		}
+		standing, ok := scores[bet.UserID]
+		if !ok {
+			standing = &aviator.TournamentStanding{UserID: bet.UserID}
+			scores[bet.UserID] = standing
+		}
+		standing.Bets++
+		switch tournament.Metric {
+		case TOURNAMENT_METRIC_MULTIPLIER:
+			standing.Score = max(standing.Score, math.Floor(float64(payout)/float64(stake)*100)/100)
+		case TOURNAMENT_METRIC_WAGERED:
+			standing.Score += fromMinor(stake, tournament.Currency)
+		case TOURNAMENT_METRIC_PROFIT:
+			standing.Score += fromMinor(payout-stake, tournament.Currency)
+		}
+	}
+	standings := make([]*aviator.TournamentStanding, 0, len(scores))
+	for _, standing := range scores {
+		standings = append(standings, standing)
+	}
+	slices.SortFunc(standings, func(a, b *aviator.TournamentStanding) int {
+		if a.Score != b.Score {
+			if a.Score > b.Score {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.UserID, b.UserID)
+	})
+	for idx, standing := range standings {
+		standing.Rank = int64(idx + 1)
+		if standing.Score > 0 {
+			standing.Prize = tournamentPrize(tournament, standing.Rank)
+		}
+	}
+	return standings, nil
+}
+
+func tournamentPrizeID(tournamentID, userID string) string {
+	return fmt.Sprintf("%s-%s", tournamentID, userID)
+}
+
+// finishTournament queues the prizes before it stores the final standings. A
+// prize is queued under an id per tournament and user, so a run that stops half
+// way leaves the tournament open and the next one queues only what is missing.
+func (server *Server) finishTournament(tournament *aviator.Tournament) error {
+	standings, err := server.tournamentStandings(tournament)
+	if err != nil {
+		return err
+	}
+	for _, standing := range standings {
+		if standing.Prize == 0 {
+			continue
+		}
+		prizeID := tournamentPrizeID(tournament.ID, standing.UserID)
+		err := server.creditWallet(context.Background(), &aviator.WalletOp{
+			ID:          prizeID,
+			Target:      "live",
+			UserID:      standing.UserID,
+			OrgID:       tournament.OrgID,
+			Reason:      WALLET_REASON_TOURNAMENT,
+			Amount:      fromMinor(standing.Prize, tournament.Currency),
+			AmountMoney: money(standing.Prize, tournament.Currency),
+			BetID:       prizeID,
+		})
+		if err != nil && !mongo.IsDuplicateKeyError(errors.Cause(err)) {
+			return err
+		}
+	}
+	update := bson.M{"$set": bson.M{"status": TOURNAMENT_FINISHED, "results": standings}}
+	filter := bson.M{"_id": tournament.ID, "status": TOURNAMENT_OPEN}
+	return errors.WithStack(server.db.UpdateOne(TOURNAMENTS_COLLECTION, filter, update))
+}
+
+// betsUnsettled tells whether the org still has bets placed before the time in
+// a round that has not ended. They are archived once their round settles.
+func (server *Server) betsUnsettled(ctx context.Context, orgID string, before int64) (bool, error) {
+	for _, state := range []string{STATE_FLYING, STATE_LOADING, STATE_PENDING} {
+		flight, err := server.flightStore.FindFlight(ctx, orgID, state)
+		if errors.Is(err, errFlightNotFound) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		bets, err := server.betStore.GetBets(ctx, orgID, flight.ID)
+		if err != nil {
+			return false, err
+		}
+		for idx := range bets {
+			if bets[idx].DateCreated < before {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// runTournaments finishes the tournaments whose window has closed.
+func (server *Server) runTournaments() {
+	for range time.NewTicker(TOURNAMENT_EVERY).C {
+		tournaments := []*aviator.Tournament{}
+		filter := bson.M{"status": TOURNAMENT_OPEN, "endsAt": bson.M{"$lte": time.Now().Unix()}}
+		if err := server.db.Find(TOURNAMENTS_COLLECTION, filter, &tournaments); err != nil {
+			server.log.Err(err).Msg("failed to read ended tournaments")
+			continue
+		}
+		for _, tournament := range tournaments {
+			if !server.ownsRounds(tournament.OrgID) {
+				continue
+			}
+			// a round that took bets before the end is still counted, the
+			// tournament waits for it to settle
+			if unsettled, err := server.betsUnsettled(context.Background(), tournament.OrgID, tournament.EndsAt); err != nil || unsettled {
+				if err != nil {
+					server.log.Err(err).Msgf("failed to check the rounds of tournament %s", tournament.ID)
+				}
+				continue
+			}
+			if err := server.finishTournament(tournament); err != nil {
+				server.log.Err(err).Msgf("failed to finish tournament %s", tournament.ID)
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/thedivinez/go-libs/services/aviator"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestTournamentWaitsForItsRounds(t *testing.T) {
+	h := newHarness(t)
+	ctx := context.Background()
+	flight := &aviator.Flight{ID: "flight-1", OrgID: testOrg, State: STATE_FLYING}
+	if err := h.server.flightStore.SaveFlight(ctx, flight); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.server.betStore.OpenBook(ctx, testOrg, flight.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.server.betStore.AddBet(ctx, &aviator.PlaneBet{BetId: "bet-1", OrgID: testOrg, FlightID: flight.ID, UserID: "gina", DateCreated: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if unsettled, err := h.server.betsUnsettled(ctx, testOrg, 101); err != nil || !unsettled {
+		t.Fatalf("a bet placed before the end rides a round that is still flying (%v)", err)
+	}
+	if unsettled, err := h.server.betsUnsettled(ctx, testOrg, 100); err != nil || unsettled {
+		t.Fatalf("bets placed after the end should not hold the tournament (%v)", err)
+	}
+	if err := h.server.flightStore.DeleteFlight(ctx, testOrg, flight.ID); err != nil {
+		t.Fatal(err)
+	}
+	if unsettled, err := h.server.betsUnsettled(ctx, testOrg, 101); err != nil || unsettled {
+		t.Fatalf("a settled round should not hold the tournament (%v)", err)
+	}
+}
+
+func TestTournamentPrizesArePaidOnce(t *testing.T) {
+	h := newHarness(t, "hana")
+	tournament := &aviator.Tournament{
+		ID: "tournament-1", OrgID: testOrg, Metric: TOURNAMENT_METRIC_WAGERED, Currency: "USD", StartsAt: 100, EndsAt: 200,
+		Prizes: []*aviator.TournamentPrize{{FromRank: 1, ToRank: 1, Amount: 500}}, Status: TOURNAMENT_OPEN,
+	}
+	if _, err := h.server.db.InsertOne(TOURNAMENTS_COLLECTION, tournament); err != nil {
+		t.Fatal(err)
+	}
+	bet := &aviator.PlaneBet{BetId: "bet-1", OrgID: testOrg, UserID: "hana", Account: "live", Stake: 10, StakeMoney: money(1000, "USD"), DateCreated: 150}
+	if _, err := h.server.db.InsertOne(BETS_COLLECTION, bet); err != nil {
+		t.Fatal(err)
+	}
+	// a run that queued the prize and stopped before the tournament was finished
+	if err := h.server.finishTournament(tournament); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.server.db.UpdateOne(TOURNAMENTS_COLLECTION, bson.M{"_id": tournament.ID}, bson.M{"$set": bson.M{"status": TOURNAMENT_OPEN}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.server.finishTournament(tournament); err != nil {
+		t.Fatalf("a tournament whose prizes were queued should still finish: %v", err)
+	}
+	if got := h.auth.balance(t, "hana"); got != 105 {
+		t.Fatalf("hana should be paid the prize once, has %v", got)
+	}
+	finished := &aviator.Tournament{}
+	if err := h.server.db.FindOne(TOURNAMENTS_COLLECTION, bson.M{"_id": tournament.ID}, finished); err != nil || finished.Status != TOURNAMENT_FINISHED {
+		t.Fatalf("the tournament should be finished, got %v (%v)", finished.Status, err)
+	}
+}
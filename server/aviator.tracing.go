@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+var tracer = otel.Tracer("github.com/thedivinez/grandaviator/server")
+
+// metadataCarrier lets the propagator write the trace context into outgoing
+// grpc metadata so the auth service joins the same trace.
+type metadataCarrier metadata.MD
+
+func (carrier metadataCarrier) Get(key string) string {
+	if values := metadata.MD(carrier).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (carrier metadataCarrier) Set(key, value string) {
+	metadata.MD(carrier).Set(key, value)
+}
+
+func (carrier metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(carrier))
+	for key := range carrier {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// initTracing exports spans to the otlp collector, or to a local file when
+// TRACE_FILE is set so tests can read them back. Without either, spans are
+// dropped by the default no-op provider.
+func (server *Server) initTracing() error {
+	var exporter sdktrace.SpanExporter
+	switch {
+	case server.config.TraceFile != "":
+		file, err := os.OpenFile(server.config.TraceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if exporter, err = stdouttrace.New(stdouttrace.WithWriter(file)); err != nil {
+			return errors.WithStack(err)
+		}
+	case server.config.OtlpEndpoint != "":
+		options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(server.config.OtlpEndpoint)}
+		if insecure, _ := strconv.ParseBool(server.config.OtlpInsecure); insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		var err error
+		if exporter, err = otlptracegrpc.New(context.Background(), options...); err != nil {
+			return errors.WithStack(err)
+		}
+	default:
+		return nil
+	}
+	ratio, err := strconv.ParseFloat(server.config.TraceSampleRatio, 64)
+	if err != nil {
+		ratio = 1
+	}
+	serviceName := server.config.ServiceName
+	if serviceName == "" {
+		serviceName = "aviator"
+	}
+	server.tracing = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(server.tracing)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if server.redis == nil {
+		return nil
+	}
+	return errors.WithStack(redisotel.InstrumentTracing(server.redis.Client))
+}
+
+// shutdownTracing flushes the spans still waiting in the batcher.
+func (server *Server) shutdownTracing(ctx context.Context) error {
+	if server.tracing == nil {
+		return nil
+	}
+	return errors.WithStack(server.tracing.Shutdown(ctx))
+}
+
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startAuthCall traces and times a call to the auth service, the returned
+// context carries the trace to it. The returned func must be called with the
+// result of the call.
+func startAuthCall(ctx context.Context, method string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := startSpan(ctx, "auth."+method, attribute.String("rpc.service", "auth"), attribute.String("rpc.method", method))
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md), func(err error) {
+		observeAuthCall(method, start, err)
+		endSpan(span, err)
+	}
+}
@@ -1,11 +1,184 @@
 package server
 
+import "time"
+
+const (
+	BETS_COLLECTION             = "bets"
+	STATE_PENDING               = "pending"
+	STATE_LOADING               = "loading"
+	STATE_FLYING                = "flying"
+	STATE_EXPLODED              = "exploded"
+	CLIENTS_COLLECTION          = "clients"
+	FLIGHTS_COLLECTION          = "flights"
+	WALLET_OPS_COLLECTION       = "wallet_ops"
+	RECONCILIATIONS_COLLECTION  = "reconciliations"
+	SETTINGS_HISTORY_COLLECTION = "settings_history"
+	JACKPOTS_COLLECTION         = "jackpots"
+	FREE_BETS_COLLECTION        = "free_bets"
+	CASHBACKS_COLLECTION        = "cashbacks"
+	TOURNAMENTS_COLLECTION      = "tournaments"
+	GAMBLING_LIMITS_COLLECTION  = "gambling_limits"
+	PLAYER_RISK_COLLECTION      = "player_risk"
+	ORG_RISK_COLLECTION         = "org_risk"
+)
+
+const (
+	WALLET_OP_PENDING   = "pending"
+	WALLET_OP_DELIVERED = "delivered"
+	WALLET_OP_REJECTED  = "rejected"
+	WALLET_OP_DEAD      = "dead"
+)
+
+const (
+	WALLET_REASON_BET        = "bet"
+	WALLET_REASON_REFUND     = "refund"
+	WALLET_REASON_CASHOUT    = "cashout"
+	WALLET_REASON_JACKPOT    = "jackpot"
+	WALLET_REASON_CASHBACK   = "cashback"
+	WALLET_REASON_TOURNAMENT = "tournament"
+)
+
+const (
+	WALLET_OP_MAX_ATTEMPTS  = 10
+	WALLET_OP_BASE_BACKOFF  = time.Second * 2
+	WALLET_OP_MAX_BACKOFF   = time.Minute * 5
+	WALLET_DISPATCH_EVERY   = time.Second * 5
+	WALLET_OP_DELIVER_LIMIT = time.Second * 5
+)
+
+// TREASURY_FUND_ATTEMPTS is how often a round tries to fund its risk while
+// other movements keep changing the pool under it.
+const TREASURY_FUND_ATTEMPTS = 5
+
+const (
+	RECONCILE_EVERY       = time.Hour
+	RECONCILE_DAY         = "2006-01-02"
+	RECONCILE_GRACE       = time.Hour
+	RECONCILE_LEDGER_PAGE = 1000
+	// RECONCILE_MAX_DAYS is how far back the job catches up on missed days
+	RECONCILE_MAX_DAYS = 31
+)
+
+const (
+	ROLE_ADMIN             = "admin"
+	ADMIN_SIGNATURE_WINDOW = time.Minute * 5
+)
+
+const (
+	// multipliers pay out in hundredths
+	ODDS_SCALE       = 100
+	DEFAULT_CURRENCY = "USD"
+)
+
+const (
+	JACKPOT_WATCH_EVERY = time.Second
+)
+
+const (
+	FREE_BET_AVAILABLE = "available"
+	FREE_BET_USED      = "used"
+	MAX_FREE_BETS      = 10000
+)
+
+const (
+	CASHBACK_EVERY          = time.Hour
+	CASHBACK_DEFAULT_PERIOD = 7
+	CASHBACK_HISTORY_LIMIT  = 10
+)
+
+const (
+	TOURNAMENT_OPEN              = "open"
+	TOURNAMENT_FINISHED          = "finished"
+	TOURNAMENT_METRIC_MULTIPLIER = "multiplier"
+	TOURNAMENT_METRIC_WAGERED    = "wagered"
+	TOURNAMENT_METRIC_PROFIT     = "profit"
+	TOURNAMENT_EVERY             = time.Minute
+	TOURNAMENT_STANDINGS_LIMIT   = 100
+)
+
+const (
+	CHAT_MUTE         = "mute"
+	CHAT_UNMUTE       = "unmute"
+	CHAT_BAN          = "ban"
+	CHAT_UNBAN        = "unban"
+	CHAT_HISTORY_SIZE = 100
+	CHAT_MAX_LENGTH   = 200
+	CHAT_RATE_LIMIT   = 5
+	CHAT_RATE_WINDOW  = time.Second * 10
+	CHAT_DEFAULT_MUTE = time.Minute * 10
+)
+
+const (
+	LIMIT_SELF_EXCLUDED    = "SELF_EXCLUDED"
+	LIMIT_DAILY_LOSS       = "DAILY_LOSS_LIMIT"
+	LIMIT_WEEKLY_LOSS      = "WEEKLY_LOSS_LIMIT"
+	LIMIT_MONTHLY_LOSS     = "MONTHLY_LOSS_LIMIT"
+	LIMIT_DAILY_WAGER      = "DAILY_WAGER_LIMIT"
+	LIMIT_SESSION_TIME     = "SESSION_TIME_LIMIT"
+	GAMBLING_SESSION_IDLE  = time.Minute * 30
+	GAMBLING_LIMITS_DOMAIN = "aviator"
+)
+
+const (
+	RATE_LIMIT_CAPACITY     = 5
+	RATE_LIMIT_REFILL       = 2
+	RATE_LIMIT_ORG_CAPACITY = 500
+	RATE_LIMIT_ORG_REFILL   = 200
+)
+
+const (
+	RISK_NONE              = "none"
+	RISK_THROTTLE          = "throttle"
+	RISK_BLOCK             = "block"
+	RISK_SCAN_EVERY        = time.Minute * 5
+	RISK_WINDOW            = time.Hour * 24
+	RISK_MIN_BETS          = 20
+	RISK_TIMING_SPREAD     = 15
+	RISK_FIXED_SHARE       = 0.9
+	RISK_CLUSTER_SIZE      = 3
+	RISK_CLUSTER_FLIGHTS   = 5
+	RISK_CASHOUT_GAP       = 50
+	RISK_THROTTLE_SCORE    = 50
+	RISK_BLOCK_SCORE       = 80
+	RISK_THROTTLE_INTERVAL = time.Second * 10
+)
+
+const (
+	FLIGHT_TICK_INTERVAL = time.Millisecond * 120
+)
+
+const (
+	SCHEDULER_WORKERS    = 64
+	SCHEDULER_SLOTS      = 1024
+	SCHEDULER_QUEUE      = 8192
+	SCHEDULER_RESOLUTION = time.Millisecond * 10
+)
+
+const (
+	BOOK_OP_OPEN       = "open"
+	BOOK_OP_ADD        = "add"
+	BOOK_OP_TAKE       = "take"
+	BOOK_OP_CLOSE      = "close"
+	BOOK_REPLICA_QUEUE = 10000
+	BOOK_FLUSH_EVERY   = time.Second
+)
+
+const (
+	ROUND_LEASE_TTL   = time.Second * 10
+	ROUND_LEASE_RENEW = time.Second * 3
+	// ROUNDS_FORWARDED_HEADER marks a bet call one instance passed on to the
+	// one running the org's rounds
+	ROUNDS_FORWARDED_HEADER = "x-aviator-forwarded"
+)
+
+const (
+	STORAGE_MEMORY     = "memory"
+	PLANE_HISTORY_SIZE = 20
+)
+
 const (
-	BETS_COLLECTION    = "bets"
-	STATE_PENDING      = "pending"
-	STATE_LOADING      = "loading"
-	STATE_FLYING       = "flying"
-	STATE_EXPLODED     = "exploded"
-	CLIENTS_COLLECTION = "clients"
-	FLIGHTS_COLLECTION = "flights"
+	HEALTH_PROBE_ID      = "health-probe"
+	HEALTH_CHECK_EVERY   = time.Second * 5
+	HEALTH_CHECK_TIMEOUT = time.Second * 2
+	PLANE_STALL_AFTER    = time.Second * 30
 )
@@ -25,6 +25,20 @@ type AuthServiceConfig struct {
 	GatewayHost string `json:"GATEWAY_HOST"`
 	Redis       string `json:"REDIS_ADDRESS"`
 	AuthServer  string `json:"AUTH_SERVER"`
+	Currency    string `json:"CURRENCY"`
+	MetricsPort string `json:"METRICS_PORT"`
+	// Storage is memory to run without redis and mongo
+	Storage string `json:"STORAGE"`
+	// OtlpEndpoint is the host:port of the otlp grpc collector spans are exported to
+	OtlpEndpoint     string `json:"OTLP_ENDPOINT"`
+	OtlpInsecure     string `json:"OTLP_INSECURE"`
+	TraceFile        string `json:"TRACE_FILE"`
+	TraceSampleRatio string `json:"TRACE_SAMPLE_RATIO"`
+	// SchedulerWorkers is the number of org rounds that can run at the same time
+	SchedulerWorkers string `json:"SCHEDULER_WORKERS"`
+	// AdvertiseAddress is the host:port the other instances reach this one at,
+	// the bets of the orgs whose rounds run here are forwarded to it
+	AdvertiseAddress string `json:"ADVERTISE_ADDRESS"`
 }
 
 func (c *AuthServiceConfig) ReadFromEnv() error {